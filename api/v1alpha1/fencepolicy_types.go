@@ -0,0 +1,98 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DefaultClusterFencePolicyName is the name of the ClusterFencePolicy which is used
+// as the default of every namespace.
+const DefaultClusterFencePolicyName = "default"
+
+// FenceMode is the mode Fence runs in for a workload.
+// +kubebuilder:validation:Enum=Enforcing;Learning
+type FenceMode string
+
+const (
+	// FenceModeEnforcing creates Sidecars which restrict egress to the learned hosts.
+	FenceModeEnforcing FenceMode = "Enforcing"
+	// FenceModeLearning only learns dependencies, without creating Sidecars.
+	FenceModeLearning FenceMode = "Learning"
+)
+
+// FencePolicySpec defines the desired behavior of Fence.
+// Unset fields fall back to the less specific policy.
+type FencePolicySpec struct {
+	// WorkloadSelector selects the pods the policy applies to. If unset, the policy
+	// applies to every pod in the namespace. It is ignored by ClusterFencePolicy.
+	// +optional
+	WorkloadSelector *metav1.LabelSelector `json:"workloadSelector,omitempty"`
+
+	// Enabled turns Fence on or off. If unset, AUTO_FENCE and the sidecar.fence.io
+	// labels decide.
+	// +optional
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// EgressHosts are added to the egress hosts of every generated Sidecar,
+	// in the Istio "namespace/dnsName" format.
+	// +optional
+	EgressHosts []string `json:"egressHosts,omitempty"`
+
+	// ExcludedDestinations are destinations which are never added to Sidecars.
+	// Shell patterns such as "*.example.com" are supported.
+	// +optional
+	ExcludedDestinations []string `json:"excludedDestinations,omitempty"`
+
+	// HostTTL is how long a learned egress host may stay unused before it is pruned.
+	// It overrides HOST_TTL, zero disables pruning.
+	// +optional
+	HostTTL *metav1.Duration `json:"hostTTL,omitempty"`
+
+	// Mode is the mode Fence runs in. Defaults to Enforcing.
+	// +optional
+	Mode FenceMode `json:"mode,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=fp
+
+// FencePolicy configures Fence for a namespace or for the workloads selected in it.
+type FencePolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec FencePolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// FencePolicyList contains a list of FencePolicy.
+type FencePolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []FencePolicy `json:"items"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster,shortName=cfp
+
+// ClusterFencePolicy configures Fence for the whole cluster. Only the one named
+// "default" is used, as the default of every namespace.
+type ClusterFencePolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec FencePolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ClusterFencePolicyList contains a list of ClusterFencePolicy.
+type ClusterFencePolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterFencePolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&FencePolicy{}, &FencePolicyList{}, &ClusterFencePolicy{}, &ClusterFencePolicyList{})
+}
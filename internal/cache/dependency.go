@@ -0,0 +1,264 @@
+package cache
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hexiaodai/fence/internal/config"
+	"github.com/hexiaodai/fence/internal/monitoring"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func NewDependency(server config.Server) *Dependency {
+	server.Logger = server.Logger.WithName("Dependency").WithValues("cache", "Dependency")
+	return &Dependency{
+		Server:     server,
+		data:       map[types.NamespacedName]map[string]*DependencyRecord{},
+		dependents: map[string]map[types.NamespacedName]struct{}{},
+		externals:  map[string]time.Time{},
+	}
+}
+
+// Dependency is the dependency graph learned from the access log stream. It records how
+// each source Sidecar used its destinations, and indexes the sources by destination.
+type Dependency struct {
+	mu sync.RWMutex
+	// map[source]map[destination]*DependencyRecord
+	data map[types.NamespacedName]map[string]*DependencyRecord
+	// map[destination]map[source]struct{}
+	dependents map[string]map[types.NamespacedName]struct{}
+	// externals maps the destinations outside the cluster to when they were last seen. Their
+	// hosts come from the Host headers of the requests, so at most MaxExternalDestinations are
+	// kept, and the least recently seen are evicted first.
+	externals map[string]time.Time
+	// generation is increased on every change
+	generation uint64
+	config.Server
+}
+
+// DependencyRecord is an edge of the dependency graph.
+type DependencyRecord struct {
+	Source      types.NamespacedName `json:"source"`
+	Destination string               `json:"destination"`
+	FirstSeen   time.Time            `json:"firstSeen"`
+	LastSeen    time.Time            `json:"lastSeen"`
+	Requests    uint64               `json:"requests"`
+	// map[responseCode]requests
+	ResponseCodes map[uint32]uint64 `json:"responseCodes,omitempty"`
+}
+
+// Record records a request from source to destination. A zero responseCode is not counted
+// in the response code histogram.
+func (d *Dependency) Record(source types.NamespacedName, destination string, responseCode uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	record := d.touch(source, destination, time.Now())
+	record.Requests++
+	if responseCode != 0 {
+		if record.ResponseCodes == nil {
+			record.ResponseCodes = map[uint32]uint64{}
+		}
+		record.ResponseCodes[responseCode]++
+	}
+}
+
+// TouchIfAbsent marks destination as used by source right now, unless it is already known.
+// It is used for destinations found in existing Sidecars, whose history is unknown.
+func (d *Dependency) TouchIfAbsent(source types.NamespacedName, destination string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.data[source][destination]; ok {
+		return
+	}
+	d.touch(source, destination, time.Now())
+}
+
+func (d *Dependency) touch(source types.NamespacedName, destination string, at time.Time) *DependencyRecord {
+	destinations, ok := d.data[source]
+	if !ok {
+		destinations = map[string]*DependencyRecord{}
+		d.data[source] = destinations
+	}
+	record, ok := destinations[destination]
+	if !ok {
+		record = &DependencyRecord{Source: source, Destination: destination, FirstSeen: at}
+		destinations[destination] = record
+	}
+	record.LastSeen = at
+	d.generation++
+
+	sources, ok := d.dependents[destination]
+	if !ok {
+		sources = map[types.NamespacedName]struct{}{}
+		d.dependents[destination] = sources
+	}
+	sources[source] = struct{}{}
+
+	if isExternalDestination(destination) {
+		seen, ok := d.externals[destination]
+		if !ok || seen.Before(at) {
+			d.externals[destination] = at
+		}
+		if !ok {
+			d.evictExternals(destination)
+		}
+	}
+	return record
+}
+
+// evictExternals drops the least recently seen external destinations, but keep, down to
+// MaxExternalDestinations.
+func (d *Dependency) evictExternals(keep string) {
+	for d.MaxExternalDestinations > 0 && len(d.externals) > d.MaxExternalDestinations {
+		oldest := ""
+		for destination, seen := range d.externals {
+			if destination == keep {
+				continue
+			}
+			if oldest == "" || seen.Before(d.externals[oldest]) {
+				oldest = destination
+			}
+		}
+		if oldest == "" {
+			return
+		}
+		for source := range d.dependents[oldest] {
+			d.forget(source, oldest)
+		}
+		delete(d.externals, oldest)
+		monitoring.DependencyExternalEvictions.Inc()
+	}
+}
+
+// isExternalDestination reports whether destination is outside the cluster, e.g. an external
+// host routed through fence-proxy, rather than the fqdn of a Service.
+func isExternalDestination(destination string) bool {
+	return !strings.HasSuffix(destination, ".svc.cluster.local")
+}
+
+// LastSeen returns when destination was last used by source.
+func (d *Dependency) LastSeen(source types.NamespacedName, destination string) (time.Time, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	record, ok := d.data[source][destination]
+	if !ok {
+		return time.Time{}, false
+	}
+	return record.LastSeen, true
+}
+
+// Forget drops destination from source.
+func (d *Dependency) Forget(source types.NamespacedName, destination string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.forget(source, destination)
+}
+
+// ForgetSource drops all destinations of source.
+func (d *Dependency) ForgetSource(source types.NamespacedName) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for destination := range d.data[source] {
+		d.forget(source, destination)
+	}
+}
+
+func (d *Dependency) forget(source types.NamespacedName, destination string) {
+	d.generation++
+	if destinations, ok := d.data[source]; ok {
+		delete(destinations, destination)
+		if len(destinations) == 0 {
+			delete(d.data, source)
+		}
+	}
+	if sources, ok := d.dependents[destination]; ok {
+		delete(sources, source)
+		if len(sources) == 0 {
+			delete(d.dependents, destination)
+			delete(d.externals, destination)
+		}
+	}
+}
+
+// Dependents returns the sources which depend on destination.
+func (d *Dependency) Dependents(destination string) []types.NamespacedName {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	sources := []types.NamespacedName{}
+	for source := range d.dependents[destination] {
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// Destinations returns the destinations of source, sorted.
+func (d *Dependency) Destinations(source types.NamespacedName) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	destinations := []string{}
+	for destination := range d.data[source] {
+		destinations = append(destinations, destination)
+	}
+	sort.Strings(destinations)
+	return destinations
+}
+
+// Records returns a copy of every edge of the dependency graph, sorted by source and destination.
+func (d *Dependency) Records() []DependencyRecord {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	records := []DependencyRecord{}
+	for _, destinations := range d.data {
+		for _, record := range destinations {
+			out := *record
+			if record.ResponseCodes != nil {
+				out.ResponseCodes = make(map[uint32]uint64, len(record.ResponseCodes))
+				for code, requests := range record.ResponseCodes {
+					out.ResponseCodes[code] = requests
+				}
+			}
+			records = append(records, out)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Source != records[j].Source {
+			return records[i].Source.String() < records[j].Source.String()
+		}
+		return records[i].Destination < records[j].Destination
+	})
+	return records
+}
+
+// Restore merges records, e.g. loaded from a store, into the dependency graph.
+// For an edge which is already known, the most recent history wins.
+func (d *Dependency) Restore(records []DependencyRecord) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, record := range records {
+		if found, ok := d.data[record.Source][record.Destination]; ok && !found.LastSeen.Before(record.LastSeen) {
+			continue
+		}
+		restored := record
+		d.touch(record.Source, record.Destination, record.LastSeen)
+		d.data[record.Source][record.Destination] = &restored
+	}
+}
+
+// Generation returns a number which changes whenever the dependency graph changes.
+func (d *Dependency) Generation() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.generation
+}
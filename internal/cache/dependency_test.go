@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hexiaodai/fence/internal/config"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestDependencyEvictsLeastRecentlySeenExternals(t *testing.T) {
+	server := config.Default()
+	server.MaxExternalDestinations = 2
+	d := NewDependency(server)
+	productpage := types.NamespacedName{Namespace: "default", Name: "deployment-productpage"}
+	reviews := types.NamespacedName{Namespace: "default", Name: "deployment-reviews"}
+
+	now := time.Now()
+	d.Restore([]DependencyRecord{
+		{Source: productpage, Destination: "old.example.com", FirstSeen: now.Add(-time.Hour), LastSeen: now.Add(-time.Hour)},
+		{Source: reviews, Destination: "old.example.com", FirstSeen: now.Add(-time.Hour), LastSeen: now.Add(-time.Hour)},
+		{Source: productpage, Destination: "api.example.com", FirstSeen: now.Add(-time.Minute), LastSeen: now.Add(-time.Minute)},
+	})
+	d.Record(reviews, "ratings.default.svc.cluster.local", 200)
+	d.Record(reviews, "new.example.com", 200)
+
+	if got, want := d.Destinations(productpage), []string{"api.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Destinations(productpage) = %v, want %v", got, want)
+	}
+	if got, want := d.Destinations(reviews), []string{"new.example.com", "ratings.default.svc.cluster.local"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Destinations(reviews) = %v, want %v", got, want)
+	}
+	if got := d.Dependents("old.example.com"); len(got) != 0 {
+		t.Errorf("Dependents(old.example.com) = %v, want none", got)
+	}
+
+	// seeing a known external destination again evicts nothing
+	d.Record(productpage, "new.example.com", 200)
+	if got := len(d.Records()); got != 4 {
+		t.Errorf("len(Records()) = %v, want 4", got)
+	}
+}
+
+func TestDependencyWithoutExternalLimit(t *testing.T) {
+	server := config.Default()
+	server.MaxExternalDestinations = 0
+	d := NewDependency(server)
+	source := types.NamespacedName{Namespace: "default", Name: "deployment-productpage"}
+
+	for _, host := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		d.Record(source, host, 200)
+	}
+	if got := len(d.Destinations(source)); got != 3 {
+		t.Errorf("len(Destinations()) = %v, want 3", got)
+	}
+}
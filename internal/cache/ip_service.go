@@ -4,7 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
-	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -14,6 +14,7 @@ import (
 	"github.com/hexiaodai/fence/internal/config"
 	"github.com/hexiaodai/fence/internal/options"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
@@ -27,15 +28,43 @@ type IpService struct {
 	IpToService sync.Map
 	// map[types.NamespacedName][]string
 	ServiceToIps sync.Map
+	// map[string]types.NamespacedName
+	IpToPod sync.Map
+	// map[string]types.NamespacedName
+	ClusterIpToService sync.Map
+	// map[types.NamespacedName][]string
+	ServiceToClusterIps sync.Map
+
+	// mu guards the endpoint slices, which are merged per service
+	mu sync.Mutex
+	// map[slice]endpointSlice
+	slices map[types.NamespacedName]endpointSlice
+	// map[service]map[slice]struct{}
+	serviceSlices map[types.NamespacedName]map[types.NamespacedName]struct{}
+	// map[ip]map[slice]struct{}, an ip may be selected by several services
+	ipSlices map[string]map[types.NamespacedName]struct{}
 	config.Server
 }
 
+// endpointSlice is the part of an EndpointSlice indexed by IpService.
+type endpointSlice struct {
+	service types.NamespacedName
+	// map[ip]pod, the pod is empty for endpoints which are not pods
+	ips map[string]types.NamespacedName
+}
+
 func NewIpService(server config.Server) *IpService {
 	server.Logger = server.Logger.WithName("IpService").WithValues("cache", "IpService")
 	return &IpService{
-		Server:       server,
-		IpToService:  sync.Map{},
-		ServiceToIps: sync.Map{},
+		Server:              server,
+		IpToService:         sync.Map{},
+		ServiceToIps:        sync.Map{},
+		IpToPod:             sync.Map{},
+		ClusterIpToService:  sync.Map{},
+		ServiceToClusterIps: sync.Map{},
+		slices:              map[types.NamespacedName]endpointSlice{},
+		serviceSlices:       map[types.NamespacedName]map[types.NamespacedName]struct{}{},
+		ipSlices:            map[string]map[types.NamespacedName]struct{}{},
 	}
 }
 
@@ -51,99 +80,295 @@ func (i *IpService) Start(ctx context.Context) error {
 
 	lw := &cache.ListWatch{
 		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-			return client.CoreV1().Endpoints("").List(ctx, metav1.ListOptions{})
+			return client.DiscoveryV1().EndpointSlices("").List(ctx, metav1.ListOptions{})
 		},
 		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-			return client.CoreV1().Endpoints("").Watch(ctx, metav1.ListOptions{})
+			return client.DiscoveryV1().EndpointSlices("").Watch(ctx, metav1.ListOptions{})
 		},
 	}
 
-	_, controller := cache.NewInformer(lw, &corev1.Endpoints{}, 60*time.Second, cache.ResourceEventHandlerFuncs{
-		AddFunc:    func(obj interface{}) { i.handleEpAdd(ctx, obj) },
-		UpdateFunc: func(oldObj, newObj interface{}) { i.handleEpUpdate(ctx, oldObj, newObj) },
-		DeleteFunc: func(obj interface{}) { i.handleEpDelete(ctx, obj) },
+	_, controller := cache.NewInformer(lw, &discoveryv1.EndpointSlice{}, 60*time.Second, cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { i.handleSliceUpdate(obj) },
+		UpdateFunc: func(_, newObj interface{}) { i.handleSliceUpdate(newObj) },
+		DeleteFunc: func(obj interface{}) { i.handleSliceDelete(obj) },
 	})
 
 	go controller.Run(ctx.Done())
 
+	svcLw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return client.CoreV1().Services("").List(ctx, metav1.ListOptions{})
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return client.CoreV1().Services("").Watch(ctx, metav1.ListOptions{})
+		},
+	}
+
+	_, svcController := cache.NewInformer(svcLw, &corev1.Service{}, 60*time.Second, cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { i.handleSvcUpdate(obj) },
+		UpdateFunc: func(_, newObj interface{}) { i.handleSvcUpdate(newObj) },
+		DeleteFunc: func(obj interface{}) { i.handleSvcDelete(obj) },
+	})
+
+	go svcController.Run(ctx.Done())
+
 	i.Logger.Info("started")
 	return nil
 }
 
-func (i *IpService) handleEpAdd(ctx context.Context, obj interface{}) {
-	ep, ok := obj.(*corev1.Endpoints)
+func (i *IpService) handleSliceUpdate(obj interface{}) {
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
 	if !ok {
 		return
 	}
-	i.addIpWithEp(ep)
+	svcName := slice.Labels[discoveryv1.LabelServiceName]
+	if svcName == "" || slice.AddressType == discoveryv1.AddressTypeFQDN {
+		return
+	}
+	es := endpointSlice{
+		service: types.NamespacedName{Namespace: slice.Namespace, Name: svcName},
+		ips:     map[string]types.NamespacedName{},
+	}
+	// not ready endpoints are indexed too, e.g. terminating pods still send requests
+	for _, endpoint := range slice.Endpoints {
+		pod := types.NamespacedName{}
+		if endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod" {
+			pod = types.NamespacedName{Namespace: endpoint.TargetRef.Namespace, Name: endpoint.TargetRef.Name}
+		}
+		for _, address := range endpoint.Addresses {
+			if ip := normalizeIp(address); ip != "" {
+				es.ips[ip] = pod
+			}
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	nn := types.NamespacedName{Namespace: slice.Namespace, Name: slice.Name}
+	i.deleteSlice(nn)
+	i.slices[nn] = es
+	if _, ok := i.serviceSlices[es.service]; !ok {
+		i.serviceSlices[es.service] = map[types.NamespacedName]struct{}{}
+	}
+	i.serviceSlices[es.service][nn] = struct{}{}
+	for ip, pod := range es.ips {
+		if _, ok := i.ipSlices[ip]; !ok {
+			i.ipSlices[ip] = map[types.NamespacedName]struct{}{}
+		}
+		i.ipSlices[ip][nn] = struct{}{}
+		i.IpToService.Store(ip, es.service)
+		if pod.Name != "" {
+			i.IpToPod.Store(ip, pod)
+		}
+	}
+	i.mergeSlices(es.service)
 }
 
-func (i *IpService) handleEpUpdate(ctx context.Context, old, obj interface{}) {
-	ep, ok := obj.(*corev1.Endpoints)
+func (i *IpService) handleSliceDelete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
 	if !ok {
 		return
 	}
-	oldEp, ok := old.(*corev1.Endpoints)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	nn := types.NamespacedName{Namespace: slice.Namespace, Name: slice.Name}
+	if es, ok := i.deleteSlice(nn); ok {
+		i.mergeSlices(es.service)
+	}
+}
+
+// deleteSlice drops the ips of the slice, or maps them to another service which selects them.
+func (i *IpService) deleteSlice(nn types.NamespacedName) (endpointSlice, bool) {
+	es, ok := i.slices[nn]
 	if !ok {
-		return
+		return es, false
 	}
+	delete(i.slices, nn)
+	delete(i.serviceSlices[es.service], nn)
+	if len(i.serviceSlices[es.service]) == 0 {
+		delete(i.serviceSlices, es.service)
+	}
+	for ip := range es.ips {
+		delete(i.ipSlices[ip], nn)
+		i.remapIp(ip)
+	}
+	return es, true
+}
 
-	if reflect.DeepEqual(oldEp.Subsets, ep.Subsets) {
+// remapIp maps the ip to a service of its remaining slices. The service it is mapped to is kept
+// if it still selects the ip, otherwise the first one by name is taken.
+func (i *IpService) remapIp(ip string) {
+	slices := i.ipSlices[ip]
+	if len(slices) == 0 {
+		delete(i.ipSlices, ip)
+		i.IpToService.Delete(ip)
+		i.IpToPod.Delete(ip)
 		return
 	}
 
-	i.deleteIpFromEp(oldEp)
-	i.addIpWithEp(ep)
+	var current types.NamespacedName
+	if value, ok := i.IpToService.Load(ip); ok {
+		current = value.(types.NamespacedName)
+	}
+	var service, pod types.NamespacedName
+	for nn := range slices {
+		es := i.slices[nn]
+		if service.Name == "" || es.service == current ||
+			(service != current && es.service.String() < service.String()) {
+			service = es.service
+		}
+		if p := es.ips[ip]; p.Name != "" {
+			pod = p
+		}
+	}
+	i.IpToService.Store(ip, service)
+	if pod.Name != "" {
+		i.IpToPod.Store(ip, pod)
+	} else {
+		i.IpToPod.Delete(ip)
+	}
 }
 
-func (i *IpService) handleEpDelete(ctx context.Context, obj interface{}) {
-	ep, ok := obj.(*corev1.Endpoints)
+// mergeSlices indexes the ips of every slice of the service.
+func (i *IpService) mergeSlices(svc types.NamespacedName) {
+	slices, ok := i.serviceSlices[svc]
 	if !ok {
+		i.ServiceToIps.Delete(svc)
 		return
 	}
-	i.deleteIpFromEp(ep)
-}
-
-func (i *IpService) addIpWithEp(ep *corev1.Endpoints) {
-	svc := types.NamespacedName{Namespace: ep.GetNamespace(), Name: ep.GetName()}
 	var addresses []string
-	for _, subset := range ep.Subsets {
-		for _, address := range subset.Addresses {
-			addresses = append(addresses, address.IP)
-			i.IpToService.Store(address.IP, svc)
+	for nn := range slices {
+		for ip := range i.slices[nn].ips {
+			addresses = append(addresses, ip)
 		}
 	}
+	sort.Strings(addresses)
 	i.ServiceToIps.Store(svc, addresses)
 }
 
-func (i *IpService) deleteIpFromEp(ep *corev1.Endpoints) {
-	svc := types.NamespacedName{Namespace: ep.GetNamespace(), Name: ep.GetName()}
+// AuthorityHost returns the host of an authority, which may be an IPv6 address in brackets.
+func AuthorityHost(authority string) string {
+	if host, _, err := net.SplitHostPort(authority); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(authority, "["), "]")
+}
+
+// AuthorityPort returns the port of an authority, or 80 if it has none.
+func AuthorityPort(authority string) string {
+	if _, port, err := net.SplitHostPort(authority); err == nil {
+		return port
+	}
+	return "80"
+}
+
+// normalizeIp returns the canonical form of an IPv4 or IPv6 address, or "" for anything else.
+func normalizeIp(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	return parsed.String()
+}
 
-	// delete svc in ServiceToIps
-	value, ok := i.ServiceToIps.LoadAndDelete(svc)
+func (i *IpService) handleSvcUpdate(obj interface{}) {
+	svc, ok := obj.(*corev1.Service)
 	if !ok {
 		return
 	}
-	ips := value.([]string)
+	i.deleteClusterIpFromSvc(svc)
 
-	// delete ips related svc
-	for _, ip := range ips {
-		i.IpToService.Delete(ip)
+	nn := types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}
+	var clusterIps []string
+	for _, ip := range svc.Spec.ClusterIPs {
+		ip = normalizeIp(ip)
+		if ip == "" {
+			// headless service
+			continue
+		}
+		clusterIps = append(clusterIps, ip)
+		i.ClusterIpToService.Store(ip, nn)
+	}
+	i.ServiceToClusterIps.Store(nn, clusterIps)
+}
+
+func (i *IpService) handleSvcDelete(obj interface{}) {
+	svc, ok := obj.(*corev1.Service)
+	if !ok {
+		return
+	}
+	i.deleteClusterIpFromSvc(svc)
+}
+
+func (i *IpService) deleteClusterIpFromSvc(svc *corev1.Service) {
+	nn := types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}
+	value, ok := i.ServiceToClusterIps.LoadAndDelete(nn)
+	if !ok {
+		return
+	}
+	for _, ip := range value.([]string) {
+		i.ClusterIpToService.Delete(ip)
 	}
 }
 
 func (i *IpService) FetchSourceIp(entry *data_accesslog.HTTPAccessLogEntry) (sourceIp string, err error) {
-	downstreamSock := entry.CommonProperties.DownstreamRemoteAddress.Address.(*envoy_config_core.Address_SocketAddress)
-	if net.ParseIP(downstreamSock.SocketAddress.Address) == nil {
+	return i.FetchSourceIpFromCommon(entry.GetCommonProperties())
+}
+
+func (i *IpService) FetchSourceIpFromCommon(common *data_accesslog.AccessLogCommon) (sourceIp string, err error) {
+	sourceIp = socketAddressIp(common.GetDownstreamRemoteAddress())
+	if sourceIp == "" {
 		err = fmt.Errorf("source ip does not exist")
-		return
 	}
-	sourceIp = downstreamSock.SocketAddress.Address
 	return
 }
 
+// FetchServiceByIp returns the service of a cluster ip or of an endpoint ip.
+func (i *IpService) FetchServiceByIp(ip string) (*types.NamespacedName, error) {
+	ip = normalizeIp(ip)
+	if value, ok := i.ClusterIpToService.Load(ip); ok {
+		svc := value.(types.NamespacedName)
+		return &svc, nil
+	}
+	return i.FetchSourceSvc(ip)
+}
+
+// FetchTCPDestinationSvc returns the destination service of a TCP access log entry. The service is
+// taken from the outbound upstream cluster, or resolved from the original destination ip.
+func (i *IpService) FetchTCPDestinationSvc(entry *data_accesslog.TCPAccessLogEntry) (destSvc string, err error) {
+	common := entry.GetCommonProperties()
+	// outbound|6379||redis.default.svc.cluster.local
+	parts := strings.Split(common.GetUpstreamCluster(), "|")
+	if len(parts) == 4 && parts[0] == "outbound" && parts[3] != "" {
+		return parts[3], nil
+	}
+
+	// PassthroughCluster. the downstream local address is the original destination.
+	for _, addr := range []*envoy_config_core.Address{common.GetDownstreamLocalAddress(), common.GetUpstreamRemoteAddress()} {
+		ip := socketAddressIp(addr)
+		if ip == "" {
+			continue
+		}
+		if svc, err := i.FetchServiceByIp(ip); err == nil {
+			return ServiceFQDN(*svc), nil
+		}
+	}
+	err = fmt.Errorf("no destination service, upstreamCluster is %v", common.GetUpstreamCluster())
+	return
+}
+
+func socketAddressIp(addr *envoy_config_core.Address) string {
+	return normalizeIp(addr.GetSocketAddress().GetAddress())
+}
+
 func (i *IpService) FetchSourceSvc(sourceIp string) (*types.NamespacedName, error) {
-	value, ok := i.IpToService.Load(sourceIp)
+	value, ok := i.IpToService.Load(normalizeIp(sourceIp))
 	if !ok {
 		return nil, fmt.Errorf("no source service, source ip is %v", sourceIp)
 	}
@@ -155,6 +380,16 @@ func (i *IpService) FetchSourceSvc(sourceIp string) (*types.NamespacedName, erro
 	return &svc, nil
 }
 
+// FetchSourcePod returns the pod of an endpoint ip.
+func (i *IpService) FetchSourcePod(sourceIp string) (*types.NamespacedName, error) {
+	value, ok := i.IpToPod.Load(normalizeIp(sourceIp))
+	if !ok {
+		return nil, fmt.Errorf("no source pod, source ip is %v", sourceIp)
+	}
+	pod := value.(types.NamespacedName)
+	return &pod, nil
+}
+
 func (i *IpService) FetchDestinationSvc(entry *data_accesslog.HTTPAccessLogEntry) (destSvc string, err error) {
 	upstreamCluster := entry.CommonProperties.UpstreamCluster
 	parts := strings.Split(upstreamCluster, "|")
@@ -162,14 +397,19 @@ func (i *IpService) FetchDestinationSvc(entry *data_accesslog.HTTPAccessLogEntry
 		err = fmt.Errorf("upstreamCluster is wrong: parts number is not 4, upstreamCluster is %v", upstreamCluster)
 		return
 	}
-	// only handle inbound access log
+	// outbound access logs come from the workloads in learning mode, and name the destination service
+	if parts[0] == "outbound" && strings.HasSuffix(parts[3], ".svc.cluster.local") {
+		destSvc = parts[3]
+		return
+	}
+	// otherwise only handle inbound access log
 	if parts[0] != "inbound" {
 		err = fmt.Errorf("this log is not inbound")
 		return
 	}
 	// get destination service info from request.authority
 	auth := entry.Request.Authority
-	dest := strings.Split(auth, ":")[0]
+	dest := AuthorityHost(auth)
 
 	// dest is ip address, skip
 	if net.ParseIP(dest) != nil {
@@ -194,7 +434,7 @@ func (i *IpService) FetchDestinationSvc(entry *data_accesslog.HTTPAccessLogEntry
 	destSvc = dest
 	switch len(destParts) {
 	case 1:
-		destSvc = fmt.Sprintf("%v.%v.svc.cluster.local", dest, sourceSvc.Namespace)
+		destSvc = ServiceFQDN(types.NamespacedName{Namespace: sourceSvc.Namespace, Name: dest})
 	case 2:
 		destSvc = i.completeDestSvcName(destParts, dest, "svc.cluster.local")
 	case 3:
@@ -215,3 +455,8 @@ func (i *IpService) completeDestSvcName(destParts []string, dest, suffix string)
 	}
 	return
 }
+
+// ServiceFQDN returns the fully qualified domain name of the service.
+func ServiceFQDN(svc types.NamespacedName) string {
+	return fmt.Sprintf("%v.%v.svc.cluster.local", svc.Name, svc.Namespace)
+}
@@ -0,0 +1,178 @@
+package cache
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hexiaodai/fence/internal/config"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newSlice(service, name string, pods map[string]string) *discoveryv1.EndpointSlice {
+	return newSliceOfType(discoveryv1.AddressTypeIPv4, service, name, pods)
+}
+
+func newSliceOfType(addressType discoveryv1.AddressType, service, name string, pods map[string]string) *discoveryv1.EndpointSlice {
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta:  metav1.ObjectMeta{Namespace: "default", Name: name, Labels: map[string]string{discoveryv1.LabelServiceName: service}},
+		AddressType: addressType,
+	}
+	for ip, pod := range pods {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses: []string{ip},
+			TargetRef: &corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: pod},
+		})
+	}
+	return slice
+}
+
+func assertSourceSvc(t *testing.T, i *IpService, ip string, want *types.NamespacedName) {
+	t.Helper()
+	got, err := i.FetchSourceSvc(ip)
+	if want == nil {
+		if err == nil {
+			t.Errorf("FetchSourceSvc(%v) = %v, want an error", ip, got)
+		}
+		return
+	}
+	if err != nil || *got != *want {
+		t.Errorf("FetchSourceSvc(%v) = %v, %v, want %v", ip, got, err, want)
+	}
+}
+
+func assertServiceIps(t *testing.T, i *IpService, svc types.NamespacedName, want []string) {
+	t.Helper()
+	var got []string
+	if value, ok := i.ServiceToIps.Load(svc); ok {
+		got = value.([]string)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ServiceToIps[%v] = %v, want %v", svc, got, want)
+	}
+}
+
+func TestDeleteSliceRemapsSharedIp(t *testing.T) {
+	i := NewIpService(config.Default())
+	reviews := types.NamespacedName{Namespace: "default", Name: "reviews"}
+	reviewsV1 := types.NamespacedName{Namespace: "default", Name: "reviews-v1"}
+
+	i.handleSliceUpdate(newSlice("reviews", "reviews-abcde", map[string]string{"10.0.0.1": "reviews-v1-0", "10.0.0.2": "reviews-v2-0"}))
+	i.handleSliceUpdate(newSlice("reviews-v1", "reviews-v1-abcde", map[string]string{"10.0.0.1": "reviews-v1-0"}))
+	assertSourceSvc(t, i, "10.0.0.1", &reviewsV1)
+
+	// the ip stays mapped to the service which still selects it
+	i.handleSliceDelete(newSlice("reviews-v1", "reviews-v1-abcde", nil))
+	assertSourceSvc(t, i, "10.0.0.1", &reviews)
+	if pod, err := i.FetchSourcePod("10.0.0.1"); err != nil || pod.Name != "reviews-v1-0" {
+		t.Errorf("FetchSourcePod(10.0.0.1) = %v, %v, want reviews-v1-0", pod, err)
+	}
+
+	i.handleSliceDelete(newSlice("reviews", "reviews-abcde", nil))
+	assertSourceSvc(t, i, "10.0.0.1", nil)
+	assertSourceSvc(t, i, "10.0.0.2", nil)
+	if pod, err := i.FetchSourcePod("10.0.0.1"); err == nil {
+		t.Errorf("FetchSourcePod(10.0.0.1) = %v, want an error", pod)
+	}
+}
+
+func TestDeleteSliceKeepsIpMovedToAnotherSlice(t *testing.T) {
+	i := NewIpService(config.Default())
+	reviews := types.NamespacedName{Namespace: "default", Name: "reviews"}
+
+	i.handleSliceUpdate(newSlice("reviews", "reviews-abcde", map[string]string{"10.0.0.1": "reviews-v1-0"}))
+	i.handleSliceUpdate(newSlice("reviews", "reviews-fghij", map[string]string{"10.0.0.1": "reviews-v1-0"}))
+	i.handleSliceDelete(newSlice("reviews", "reviews-abcde", nil))
+	assertSourceSvc(t, i, "10.0.0.1", &reviews)
+
+	// an updated slice drops the ips it no longer holds
+	i.handleSliceUpdate(newSlice("reviews", "reviews-fghij", map[string]string{"10.0.0.2": "reviews-v1-1"}))
+	assertSourceSvc(t, i, "10.0.0.1", nil)
+	assertSourceSvc(t, i, "10.0.0.2", &reviews)
+}
+
+func TestIpv6Slice(t *testing.T) {
+	i := NewIpService(config.Default())
+	reviews := types.NamespacedName{Namespace: "default", Name: "reviews"}
+
+	// the addresses are indexed in their canonical form
+	i.handleSliceUpdate(newSliceOfType(discoveryv1.AddressTypeIPv6, "reviews", "reviews-abcde", map[string]string{"FD00:0:0:0::1": "reviews-v1-0"}))
+	assertServiceIps(t, i, reviews, []string{"fd00::1"})
+	for _, ip := range []string{"fd00::1", "fd00:0000::0001", "FD00::1"} {
+		assertSourceSvc(t, i, ip, &reviews)
+	}
+	if pod, err := i.FetchSourcePod("fd00::1"); err != nil || pod.Name != "reviews-v1-0" {
+		t.Errorf("FetchSourcePod(fd00::1) = %v, %v, want reviews-v1-0", pod, err)
+	}
+
+	i.handleSliceDelete(newSliceOfType(discoveryv1.AddressTypeIPv6, "reviews", "reviews-abcde", nil))
+	assertSourceSvc(t, i, "fd00::1", nil)
+	assertServiceIps(t, i, reviews, nil)
+}
+
+func TestDualStackService(t *testing.T) {
+	i := NewIpService(config.Default())
+	reviews := types.NamespacedName{Namespace: "default", Name: "reviews"}
+
+	i.handleSliceUpdate(newSliceOfType(discoveryv1.AddressTypeIPv4, "reviews", "reviews-abcde", map[string]string{"10.0.0.1": "reviews-v1-0"}))
+	i.handleSliceUpdate(newSliceOfType(discoveryv1.AddressTypeIPv6, "reviews", "reviews-fghij", map[string]string{"fd00::1": "reviews-v1-0"}))
+	assertServiceIps(t, i, reviews, []string{"10.0.0.1", "fd00::1"})
+	assertSourceSvc(t, i, "10.0.0.1", &reviews)
+	assertSourceSvc(t, i, "fd00::1", &reviews)
+
+	// deleting one family keeps the other
+	i.handleSliceDelete(newSliceOfType(discoveryv1.AddressTypeIPv6, "reviews", "reviews-fghij", nil))
+	assertServiceIps(t, i, reviews, []string{"10.0.0.1"})
+	assertSourceSvc(t, i, "10.0.0.1", &reviews)
+	assertSourceSvc(t, i, "fd00::1", nil)
+
+	i.handleSliceDelete(newSliceOfType(discoveryv1.AddressTypeIPv4, "reviews", "reviews-abcde", nil))
+	assertServiceIps(t, i, reviews, nil)
+	assertSourceSvc(t, i, "10.0.0.1", nil)
+}
+
+func TestAuthority(t *testing.T) {
+	tests := []struct {
+		authority string
+		host      string
+		port      string
+	}{
+		{authority: "reviews.default.svc.cluster.local:9080", host: "reviews.default.svc.cluster.local", port: "9080"},
+		{authority: "reviews", host: "reviews", port: "80"},
+		{authority: "10.0.0.1:8080", host: "10.0.0.1", port: "8080"},
+		{authority: "[::1]:8080", host: "::1", port: "8080"},
+		{authority: "[fd00::1]", host: "fd00::1", port: "80"},
+		{authority: "fd00::1", host: "fd00::1", port: "80"},
+	}
+	for _, tt := range tests {
+		if got := AuthorityHost(tt.authority); got != tt.host {
+			t.Errorf("AuthorityHost(%v) = %v, want %v", tt.authority, got, tt.host)
+		}
+		if got := AuthorityPort(tt.authority); got != tt.port {
+			t.Errorf("AuthorityPort(%v) = %v, want %v", tt.authority, got, tt.port)
+		}
+	}
+}
+
+func TestNormalizeIp(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "10.0.0.1", want: "10.0.0.1"},
+		{ip: "::1", want: "::1"},
+		{ip: "0:0:0:0:0:0:0:1", want: "::1"},
+		{ip: "FD00:0000::0001", want: "fd00::1"},
+		{ip: "::ffff:10.0.0.1", want: "10.0.0.1"},
+		{ip: "[::1]", want: ""},
+		{ip: "reviews", want: ""},
+		{ip: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeIp(tt.ip); got != tt.want {
+			t.Errorf("normalizeIp(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -19,9 +19,8 @@ import (
 func NewNamespace(server config.Server) *Namespace {
 	server.Logger = server.Logger.WithName("Namespace").WithValues("cache", "Namespace")
 	return &Namespace{
-		Server:  server,
-		Disable: sync.Map{},
-		Enabled: sync.Map{},
+		Server: server,
+		states: map[string]NamespaceState{},
 	}
 }
 
@@ -59,11 +58,31 @@ func (ns *Namespace) Start(ctx context.Context) error {
 	return nil
 }
 
+// NamespaceState is the state of a namespace, set by its sidecar.fence.io label.
+type NamespaceState string
+
+const (
+	// NamespaceUnlabeled namespaces are managed if AutoFence is set.
+	NamespaceUnlabeled NamespaceState = ""
+	NamespaceEnabled   NamespaceState = config.SidecarFenceValueEnabled
+	NamespaceDisabled  NamespaceState = config.SidecarFenceValueDisable
+)
+
+// namespaceState returns the state set by the labels of a namespace. Unknown values of the
+// label leave the namespace unlabeled.
+func namespaceState(labels map[string]string) NamespaceState {
+	switch state := NamespaceState(labels[config.SidecarFenceLabel]); state {
+	case NamespaceEnabled, NamespaceDisabled:
+		return state
+	}
+	return NamespaceUnlabeled
+}
+
 type Namespace struct {
-	// map[namespaceName]struct{}
-	Disable sync.Map
-	// map[namespaceName]struct{}
-	Enabled sync.Map
+	mu sync.RWMutex
+	// map[namespaceName]NamespaceState, without the unlabeled namespaces
+	states   map[string]NamespaceState
+	handlers []func(name string, from, to NamespaceState)
 	config.Server
 }
 
@@ -72,41 +91,64 @@ func (ns *Namespace) handleNamespaceUpdate(obj interface{}) {
 	if !ok {
 		return
 	}
-	if nsv.Labels[config.SidecarFenceLabel] == config.SidecarFenceValueDisable {
-		ns.SetDisable(nsv.Name)
-	}
-	if nsv.Labels[config.SidecarFenceLabel] == config.SidecarFenceValueEnabled {
-		ns.SetEnabled(nsv.Name)
-	}
+	ns.transition(nsv.Name, namespaceState(nsv.Labels))
 }
 
 func (ns *Namespace) handleNamespaceDelete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
 	nsv, ok := obj.(*corev1.Namespace)
 	if !ok {
 		return
 	}
-	ns.Delete(nsv.Name)
+	// the Services of the namespace are gone along with it, there is nothing to reconcile
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	delete(ns.states, nsv.Name)
 }
 
-func (ns *Namespace) IsDisable(name string) bool {
-	_, ok := ns.Disable.Load(name)
-	return ok
+// transition moves the namespace to the state to, and calls the handlers if it changed.
+func (ns *Namespace) transition(name string, to NamespaceState) {
+	ns.mu.Lock()
+	from := ns.states[name]
+	if from == to {
+		ns.mu.Unlock()
+		return
+	}
+	if to == NamespaceUnlabeled {
+		delete(ns.states, name)
+	} else {
+		ns.states[name] = to
+	}
+	handlers := ns.handlers
+	ns.mu.Unlock()
+
+	ns.Logger.Sugar().Infow("namespace state changed", "namespace", name, "from", from, "to", to)
+	for _, fn := range handlers {
+		fn(name, from, to)
+	}
 }
 
-func (ns *Namespace) IsEnabled(name string) bool {
-	_, ok := ns.Enabled.Load(name)
-	return ok
+// OnTransition registers fn, called once the state of a namespace changed from from to to.
+// fn is called by the informer, it must not block.
+func (ns *Namespace) OnTransition(fn func(name string, from, to NamespaceState)) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.handlers = append(ns.handlers, fn)
 }
 
-func (ns *Namespace) SetDisable(name string) {
-	ns.Disable.Store(name, struct{}{})
+// State returns the state of the namespace.
+func (ns *Namespace) State(name string) NamespaceState {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	return ns.states[name]
 }
 
-func (ns *Namespace) SetEnabled(name string) {
-	ns.Enabled.Store(name, struct{}{})
+func (ns *Namespace) IsDisable(name string) bool {
+	return ns.State(name) == NamespaceDisabled
 }
 
-func (ns *Namespace) Delete(name string) {
-	ns.Disable.Delete(name)
-	ns.Enabled.Delete(name)
+func (ns *Namespace) IsEnabled(name string) bool {
+	return ns.State(name) == NamespaceEnabled
 }
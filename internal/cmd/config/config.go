@@ -0,0 +1,43 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/hexiaodai/fence/internal/config"
+	"github.com/spf13/cobra"
+)
+
+// GetConfigCommand returns the config command, shared by the controller and the proxy.
+func GetConfigCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Fence Configuration",
+	}
+
+	cmd.AddCommand(getPrintCommand())
+
+	return cmd
+}
+
+func getPrintCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "print",
+		Short:        "Print the effective configuration, merged from the configuration file, the environment variables and the flags",
+		SilenceUsage: true,
+	}
+	flags := config.AddFlags(cmd.Flags())
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		server, err := flags.Load()
+		if err != nil {
+			return err
+		}
+		data, err := server.YAML()
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(cmd.OutOrStdout(), string(data))
+		return nil
+	}
+
+	return cmd
+}
@@ -1,6 +1,9 @@
 package ctrl
 
-import "github.com/spf13/cobra"
+import (
+	cmdconfig "github.com/hexiaodai/fence/internal/cmd/config"
+	"github.com/spf13/cobra"
+)
 
 func GetRootCommand() *cobra.Command {
 	cmd := &cobra.Command{
@@ -10,6 +13,7 @@ func GetRootCommand() *cobra.Command {
 	}
 
 	cmd.AddCommand(getServerCommand())
+	cmd.AddCommand(cmdconfig.GetConfigCommand())
 
 	return cmd
 }
@@ -4,6 +4,7 @@ import (
 	"github.com/hexiaodai/fence/internal/config"
 	"github.com/hexiaodai/fence/internal/controller"
 	"github.com/hexiaodai/fence/internal/healthz"
+	"github.com/hexiaodai/fence/internal/monitoring"
 	"github.com/spf13/cobra"
 	ctrl "sigs.k8s.io/controller-runtime"
 )
@@ -13,22 +14,27 @@ func getServerCommand() *cobra.Command {
 		Use:     "controller",
 		Aliases: []string{"ctrl", "controller"},
 		Short:   "Fence Controller",
-		RunE: func(cmd *cobra.Command, args []string) error {
-			return server()
-		},
+		// the flags are listed by --help, not on every startup error
+		SilenceUsage: true,
+	}
+	flags := config.AddFlags(cmd.Flags())
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		server, err := flags.Load()
+		if err != nil {
+			return err
+		}
+		return setupRunners(flags, server)
 	}
 
 	return cmd
 }
 
-func server() error {
-	return setupRunners()
-}
-
-func setupRunners() error {
+func setupRunners(flags *config.Flags, server config.Server) error {
 	ctx := ctrl.SetupSignalHandler()
 
-	server := config.New()
+	if err := flags.Watch(ctx, server); err != nil {
+		return err
+	}
 
 	ctrlrunner := controller.New(server)
 	if err := ctrlrunner.Start(ctx); err != nil {
@@ -40,6 +46,11 @@ func setupRunners() error {
 		return err
 	}
 
+	monitoringRunner := monitoring.New(server)
+	if err := monitoringRunner.Start(); err != nil {
+		return err
+	}
+
 	<-ctx.Done()
 	return nil
 }
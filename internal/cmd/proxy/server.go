@@ -3,6 +3,7 @@ package proxy
 import (
 	"github.com/hexiaodai/fence/internal/config"
 	"github.com/hexiaodai/fence/internal/healthz"
+	"github.com/hexiaodai/fence/internal/monitoring"
 	httpproxy "github.com/hexiaodai/fence/internal/proxy"
 	"github.com/spf13/cobra"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -13,22 +14,27 @@ func getServerCommand() *cobra.Command {
 		Use:     "proxy",
 		Aliases: []string{"proxy"},
 		Short:   "Fence Proxy",
-		RunE: func(cmd *cobra.Command, args []string) error {
-			return server()
-		},
+		// the flags are listed by --help, not on every startup error
+		SilenceUsage: true,
+	}
+	flags := config.AddFlags(cmd.Flags())
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		server, err := flags.Load()
+		if err != nil {
+			return err
+		}
+		return setupRunners(flags, server)
 	}
 
 	return cmd
 }
 
-func server() error {
-	return setupRunners()
-}
-
-func setupRunners() error {
+func setupRunners(flags *config.Flags, server config.Server) error {
 	ctx := ctrl.SetupSignalHandler()
 
-	server := config.New()
+	if err := flags.Watch(ctx, server); err != nil {
+		return err
+	}
 
 	proxyrunner := httpproxy.New(server)
 	if err := proxyrunner.Start(ctx); err != nil {
@@ -40,6 +46,11 @@ func setupRunners() error {
 		return err
 	}
 
-	<-ctx.Done()
+	monitoringRunner := monitoring.New(server)
+	if err := monitoringRunner.Start(); err != nil {
+		return err
+	}
+
+	proxyrunner.Wait(ctx)
 	return nil
 }
@@ -1,16 +1,26 @@
 package config
 
 import (
-	"strconv"
+	"time"
 
 	"github.com/hexiaodai/fence/internal/logging"
-	"github.com/hexiaodai/fence/internal/utils"
 )
 
 const (
 	SidecarFenceLabel        = "sidecar.fence.io"
 	SidecarFenceValueEnabled = "enabled"
 	SidecarFenceValueDisable = "disable"
+
+	// FenceModeLabel sets the mode of a namespace, overridden by the FencePolicies.
+	FenceModeLabel          = "sidecar.fence.io/mode"
+	FenceModeValueLearning  = "learning"
+	FenceModeValueEnforcing = "enforcing"
+
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	ManagedByValue = "fence"
+
+	// PolicyEgressHostsAnnotation records the egress hosts added to a Sidecar by FencePolicies.
+	PolicyEgressHostsAnnotation = "fence.io/policy-egress-hosts"
 )
 
 // Server wraps the Fence configuration and additional parameters
@@ -26,23 +36,113 @@ type Server struct {
 	WormholePort string
 	// AutoFence is an automatic management sidecar.
 	AutoFence bool
+	// ExcludeNamespaces are the patterns of the namespaces left alone by Fence, along with
+	// FenceNamespace and IstioNamespace. A pattern is a glob, or a regular expression between
+	// slashes.
+	ExcludeNamespaces []string
+	// IncludeNamespaces, if set, are the patterns of the only namespaces managed by Fence.
+	// ExcludeNamespaces take precedence.
+	IncludeNamespaces []string
+	// NamespaceSelector is the label selector of the namespaces managed by Fence, e.g.
+	// "env in (prod,staging)". Empty selects all the namespaces.
+	NamespaceSelector string
 	// LogSourcePort is the LogSource port.
 	LogSourcePort string
+	// GraphPort is the dependency graph export port.
+	GraphPort string
+	// MetricsPort is the Prometheus metrics port.
+	MetricsPort string
+	// HostTTL is how long a learned egress host may stay unused before
+	// it is pruned from the Sidecar. Zero disables pruning.
+	HostTTL time.Duration
+	// PruneInterval is the interval between two egress host pruning passes.
+	PruneInterval time.Duration
+	// MaxExternalDestinations is the maximum number of destinations outside the cluster kept in
+	// the dependency graph. The least recently seen are evicted first. Zero means no limit.
+	MaxExternalDestinations int
+	// DependencyStore is where the learned dependencies are persisted.
+	// DependencyStore options: none/configmap/file.
+	DependencyStore string
+	// DependencyStorePath is the path of the file store.
+	DependencyStorePath string
+	// DependencySaveInterval is the interval between two saves of the learned dependencies.
+	DependencySaveInterval time.Duration
+	// ProposalInterval is the interval between two updates of the Sidecars proposed
+	// for the workloads in learning mode.
+	ProposalInterval time.Duration
+	// SidecarBatchInterval is the interval between two flushes of the egress hosts learned from
+	// the access log stream to the Sidecars.
+	SidecarBatchInterval time.Duration
+	// SidecarWriteQPS and SidecarWriteBurst limit the rate of the Sidecar updates of a flush.
+	SidecarWriteQPS   int
+	SidecarWriteBurst int
+	// AccessLogQueueSize is the number of access log messages queued between the log streams
+	// and the AccessLogWorkers. The messages received while it is full are dropped.
+	AccessLogQueueSize int
+	AccessLogWorkers   int
+	// ProxyMaxDestinations is the maximum number of original destinations the wormhole proxy
+	// keeps connections to. Zero means no limit.
+	ProxyMaxDestinations int
+	// ProxyMaxIdleConnsPerDestination is the maximum number of idle connections kept per
+	// original destination.
+	ProxyMaxIdleConnsPerDestination int
+	// ProxyMaxConnsPerDestination is the maximum number of connections per original
+	// destination. Zero means no limit.
+	ProxyMaxConnsPerDestination int
+	// ProxyIdleTimeout is how long idle connections, and the original destinations without
+	// requests, are kept by the wormhole proxy.
+	ProxyIdleTimeout time.Duration
+	// ProxyFlushInterval is how often the wormhole proxy flushes the responses while they are
+	// copied to the client, e.g. for long polling. Zero flushes only at the end. Server-Sent
+	// Events and gRPC streams are always flushed immediately.
+	ProxyFlushInterval time.Duration
+	// ProxyDrainTimeout is how long a wormhole listener, closed once its port is unbound from
+	// fence-proxy, keeps serving the requests in flight.
+	ProxyDrainTimeout time.Duration
+	// LogLevel is the level of the Logger. LogLevel options: debug/info/warn/error.
+	LogLevel string
 	// Logger is the logr implementation used by Fence.
 	Logger logging.Logger
+
+	// live is shared by the copies of the Server, and holds its reloaded configuration
+	live *Live
+	// namespaces is compiled from the namespace options when the Server is loaded
+	namespaces *namespaceScope
 }
 
-// New returns a Server with default parameters.
-func New() Server {
-	autoFence, _ := strconv.ParseBool(utils.Lookup("AUTO_FENCE", "true"))
+// Default returns a Server with default parameters.
+func Default() Server {
 	return Server{
-		FenceNamespace: utils.Lookup("FENCE_NAMESPACE", "fence"),
-		IstioNamespace: utils.Lookup("ISTIO_NAMESPACE", "istio-system"),
-		ProbePort:      utils.Lookup("PROBE_PORT", "16021"),
-		WormholePort:   utils.Lookup("WORMHOLE_PORT", "80"),
-		AutoFence:      autoFence,
-		LogSourcePort:  utils.Lookup("LOG_SOURCE_PORT", "8082"),
+		FenceNamespace:          "fence",
+		IstioNamespace:          "istio-system",
+		ProbePort:               "16021",
+		WormholePort:            "80",
+		AutoFence:               true,
+		ExcludeNamespaces:       []string{"kube-system"},
+		LogSourcePort:           "8082",
+		GraphPort:               "8083",
+		MetricsPort:             "8084",
+		HostTTL:                 0,
+		PruneInterval:           time.Minute,
+		MaxExternalDestinations: 1024,
+		DependencyStore:         "configmap",
+		DependencyStorePath:     "/var/lib/fence/dependencies.json",
+		DependencySaveInterval:  time.Minute,
+		ProposalInterval:        time.Minute,
+		SidecarBatchInterval:    time.Second,
+		SidecarWriteQPS:         10,
+		SidecarWriteBurst:       20,
+		AccessLogQueueSize:      1024,
+		AccessLogWorkers:        4,
+		// the wormhole proxy connection pool
+		ProxyMaxDestinations:            1024,
+		ProxyMaxIdleConnsPerDestination: 16,
+		ProxyMaxConnsPerDestination:     0,
+		ProxyIdleTimeout:                90 * time.Second,
+		ProxyFlushInterval:              100 * time.Millisecond,
+		ProxyDrainTimeout:               30 * time.Second,
+		LogLevel:                        logging.LogLevelInfo,
 		// the default logger
-		Logger: logging.DefaultLogger(logging.LogLevel(utils.Lookup("LOG_LEVEL", logging.LogLevelInfo))),
+		Logger: logging.DefaultLogger(logging.LogLevelInfo),
 	}
 }
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hexiaodai/fence/internal/logging"
+)
+
+// reloadable are the options applied without restart when the configuration file changes.
+var reloadable = map[string]struct{}{
+	"autoFence":                       {},
+	"excludeNamespaces":               {},
+	"includeNamespaces":               {},
+	"namespaceSelector":               {},
+	"logLevel":                        {},
+	"proxyMaxDestinations":            {},
+	"proxyMaxIdleConnsPerDestination": {},
+	"proxyMaxConnsPerDestination":     {},
+	"proxyIdleTimeout":                {},
+	"proxyFlushInterval":              {},
+}
+
+// Live holds the configuration of a running process, reloaded from its configuration file.
+type Live struct {
+	mu       sync.RWMutex
+	current  Server
+	handlers []func(old, new Server)
+}
+
+// Current returns the latest configuration, with the reloaded options. It is s itself if s
+// was not loaded from Flags.
+func (s Server) Current() Server {
+	if s.live == nil {
+		return s
+	}
+	s.live.mu.RLock()
+	defer s.live.mu.RUnlock()
+	return s.live.current
+}
+
+// OnReload registers fn, called with the previous and the new configuration after each reload.
+func (s Server) OnReload(fn func(old, new Server)) {
+	if s.live == nil {
+		return
+	}
+	s.live.mu.Lock()
+	defer s.live.mu.Unlock()
+	s.live.handlers = append(s.live.handlers, fn)
+}
+
+// Watch reloads the configuration file of server when it changes, until ctx is done. The
+// reloadable options are applied, the others need a restart.
+func (f *Flags) Watch(ctx context.Context, server Server) error {
+	if f.path == "" || server.live == nil {
+		return nil
+	}
+	log := server.Logger.WithName("Config").WithValues("config", f.path)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// the directory is watched, ConfigMap volumes replace the file by swapping a symlink
+	if err := watcher.Add(filepath.Dir(f.path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch configuration file: %w", err)
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				f.reload(server.live, log)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error(err, "failed to watch configuration file")
+			}
+		}
+	}()
+	log.Info("watching configuration file")
+	return nil
+}
+
+func (f *Flags) reload(live *Live, log logging.Logger) {
+	next, err := f.merge()
+	if err != nil {
+		log.Error(err, "failed to reload configuration, keeping the current one")
+		return
+	}
+
+	live.mu.Lock()
+	old := live.current
+	applied := old
+	changed := []string{}
+	for _, o := range options {
+		oldValue := reflect.ValueOf(o.field(&old)).Elem()
+		nextValue := reflect.ValueOf(o.field(&next)).Elem()
+		if reflect.DeepEqual(oldValue.Interface(), nextValue.Interface()) {
+			continue
+		}
+		if _, ok := reloadable[o.name]; !ok {
+			log.Info("option changed, restart to apply it", "option", o.name)
+			continue
+		}
+		reflect.ValueOf(o.field(&applied)).Elem().Set(nextValue)
+		changed = append(changed, o.name)
+	}
+	if len(changed) == 0 {
+		live.mu.Unlock()
+		return
+	}
+	applied.namespaces = next.namespaces
+	live.current = applied
+	handlers := append([]func(old, new Server){}, live.handlers...)
+	live.mu.Unlock()
+
+	applied.Logger.SetLevel(logging.LogLevel(applied.LogLevel))
+	log.Info("configuration reloaded", "options", changed)
+	for _, fn := range handlers {
+		fn(old, applied)
+	}
+}
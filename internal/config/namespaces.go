@@ -0,0 +1,104 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// namespaceScope holds the compiled namespace options of a Server.
+type namespaceScope struct {
+	exclude  []func(name string) bool
+	include  []func(name string) bool
+	selector labels.Selector
+}
+
+func newNamespaceScope(s Server) (*namespaceScope, error) {
+	scope := &namespaceScope{}
+	errs := []error{}
+	for _, p := range s.ExcludeNamespaces {
+		match, err := compileNamespacePattern(p)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("excludeNamespaces: %w", err))
+			continue
+		}
+		scope.exclude = append(scope.exclude, match)
+	}
+	for _, p := range s.IncludeNamespaces {
+		match, err := compileNamespacePattern(p)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("includeNamespaces: %w", err))
+			continue
+		}
+		scope.include = append(scope.include, match)
+	}
+	selector, err := labels.Parse(s.NamespaceSelector)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("namespaceSelector: %w", err))
+	}
+	scope.selector = selector
+	return scope, errors.Join(errs...)
+}
+
+// compileNamespacePattern returns the matcher of a namespace pattern. A pattern between slashes,
+// e.g. /^knative-.*$/, is a regular expression, any other one a glob, e.g. knative-*, which
+// matches the whole name.
+func compileNamespacePattern(pattern string) (func(name string) bool, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %w", pattern, err)
+		}
+		return re.MatchString, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %w", pattern, err)
+	}
+	return func(name string) bool {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}, nil
+}
+
+func matchAny(matchers []func(name string) bool, name string) bool {
+	for _, match := range matchers {
+		if match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Server) namespaceScope() *namespaceScope {
+	if s.namespaces != nil {
+		return s.namespaces
+	}
+	// s was not loaded from Flags, the invalid patterns are ignored
+	scope, _ := newNamespaceScope(s)
+	return scope
+}
+
+// ExcludesNamespace reports whether the namespace is left alone by Fence because of its name:
+// it is FenceNamespace or IstioNamespace, it matches ExcludeNamespaces, or IncludeNamespaces
+// is set and it matches none of them.
+func (s Server) ExcludesNamespace(namespace string) bool {
+	current := s.Current()
+	if namespace == current.FenceNamespace || namespace == current.IstioNamespace {
+		return true
+	}
+	scope := current.namespaceScope()
+	if matchAny(scope.exclude, namespace) {
+		return true
+	}
+	return len(scope.include) > 0 && !matchAny(scope.include, namespace)
+}
+
+// SelectsNamespace reports whether the labels of a namespace match NamespaceSelector.
+// Any namespace is selected when it is empty.
+func (s Server) SelectsNamespace(namespaceLabels map[string]string) bool {
+	return s.Current().namespaceScope().selector.Matches(labels.Set(namespaceLabels))
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileNamespacePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		matches []string
+		misses  []string
+	}{
+		{pattern: "kube-system", matches: []string{"kube-system"}, misses: []string{"kube-system-2", "kube"}},
+		{pattern: "knative-*", matches: []string{"knative-serving", "knative-"}, misses: []string{"knative", "my-knative-serving"}},
+		{pattern: "team-?", matches: []string{"team-a"}, misses: []string{"team-ab"}},
+		{pattern: "*-system", matches: []string{"kube-system", "istio-system"}, misses: []string{"system"}},
+		// a regular expression matches anywhere in the name unless anchored
+		{pattern: "/^knative-.*$/", matches: []string{"knative-serving"}, misses: []string{"my-knative-serving"}},
+		{pattern: "/knative/", matches: []string{"knative-serving", "my-knative-serving"}, misses: []string{"kube-system"}},
+		{pattern: "/^team-(a|b)$/", matches: []string{"team-a", "team-b"}, misses: []string{"team-c", "team-ab"}},
+		// a single slash is a glob
+		{pattern: "/", matches: []string{"/"}, misses: []string{"default"}},
+	}
+	for _, tt := range tests {
+		match, err := compileNamespacePattern(tt.pattern)
+		if err != nil {
+			t.Errorf("compileNamespacePattern(%q) error = %v", tt.pattern, err)
+			continue
+		}
+		for _, name := range tt.matches {
+			if !match(name) {
+				t.Errorf("%q does not match %q, want a match", tt.pattern, name)
+			}
+		}
+		for _, name := range tt.misses {
+			if match(name) {
+				t.Errorf("%q matches %q, want no match", tt.pattern, name)
+			}
+		}
+	}
+}
+
+func TestCompileNamespacePatternErrors(t *testing.T) {
+	for _, pattern := range []string{"/team-(/", "team-[", "[a-"} {
+		if _, err := compileNamespacePattern(pattern); err == nil {
+			t.Errorf("compileNamespacePattern(%q) error = nil, want an error", pattern)
+		}
+	}
+}
+
+func TestExcludesNamespace(t *testing.T) {
+	tests := []struct {
+		name     string
+		exclude  []string
+		include  []string
+		excluded []string
+		managed  []string
+	}{
+		{
+			name:     "defaults",
+			exclude:  []string{"kube-system"},
+			excluded: []string{"kube-system", "fence", "istio-system"},
+			managed:  []string{"default", "kube-public"},
+		},
+		{
+			name:     "exclude globs and regular expressions",
+			exclude:  []string{"knative-*", "/^team-[0-9]+$/"},
+			excluded: []string{"knative-serving", "team-1"},
+			managed:  []string{"default", "team-a"},
+		},
+		{
+			name:     "include only",
+			include:  []string{"team-*", "/^default$/"},
+			excluded: []string{"kube-system", "payments"},
+			managed:  []string{"team-a", "default"},
+		},
+		{
+			name:     "exclude over include",
+			exclude:  []string{"team-legacy"},
+			include:  []string{"team-*"},
+			excluded: []string{"team-legacy", "default"},
+			managed:  []string{"team-a"},
+		},
+		{
+			name:     "fence and istio namespaces always excluded",
+			include:  []string{"*"},
+			excluded: []string{"fence", "istio-system"},
+			managed:  []string{"default", "kube-system"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Default()
+			s.ExcludeNamespaces = tt.exclude
+			s.IncludeNamespaces = tt.include
+			scope, err := newNamespaceScope(s)
+			if err != nil {
+				t.Fatalf("newNamespaceScope() error = %v", err)
+			}
+			s.namespaces = scope
+			for _, ns := range tt.excluded {
+				if !s.ExcludesNamespace(ns) {
+					t.Errorf("ExcludesNamespace(%v) = false, want true", ns)
+				}
+			}
+			for _, ns := range tt.managed {
+				if s.ExcludesNamespace(ns) {
+					t.Errorf("ExcludesNamespace(%v) = true, want false", ns)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectsNamespace(t *testing.T) {
+	tests := []struct {
+		selector string
+		labels   map[string]string
+		want     bool
+	}{
+		{selector: "", labels: nil, want: true},
+		{selector: "", labels: map[string]string{"team": "payments"}, want: true},
+		{selector: "team=payments", labels: map[string]string{"team": "payments"}, want: true},
+		{selector: "team=payments", labels: map[string]string{"team": "search"}, want: false},
+		{selector: "team=payments", labels: nil, want: false},
+		{selector: "team in (payments,search),env!=dev", labels: map[string]string{"team": "search", "env": "prod"}, want: true},
+		{selector: "team in (payments,search),env!=dev", labels: map[string]string{"team": "search", "env": "dev"}, want: false},
+		{selector: "!legacy", labels: map[string]string{"team": "search"}, want: true},
+		{selector: "!legacy", labels: map[string]string{"legacy": "true"}, want: false},
+	}
+	for _, tt := range tests {
+		s := Default()
+		s.NamespaceSelector = tt.selector
+		if got := s.SelectsNamespace(tt.labels); got != tt.want {
+			t.Errorf("SelectsNamespace(%v) with %q = %v, want %v", tt.labels, tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestNewNamespaceScopeErrors(t *testing.T) {
+	s := Default()
+	s.ExcludeNamespaces = []string{"/team-(/"}
+	s.IncludeNamespaces = []string{"team-["}
+	s.NamespaceSelector = "team in payments"
+	_, err := newNamespaceScope(s)
+	if err == nil {
+		t.Fatal("newNamespaceScope() error = nil, want an error")
+	}
+	for _, want := range []string{"excludeNamespaces", "includeNamespaces", "namespaceSelector"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("newNamespaceScope() error = %v, want it to contain %q", err, want)
+		}
+	}
+}
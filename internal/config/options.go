@@ -0,0 +1,289 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/hexiaodai/fence/internal/logging"
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+// APIVersion and Kind identify the format of the configuration file.
+const (
+	APIVersion = "fence.io/v1alpha1"
+	Kind       = "FenceConfig"
+)
+
+// option is a parameter of the Server. Its value is, in order of precedence, the one of its flag,
+// of its environment variable, of the configuration file, or its default value.
+type option struct {
+	// name is the key of the option in the configuration file
+	name  string
+	env   string
+	usage string
+	// field returns the pointer to the field of the option in s
+	field func(s *Server) any
+}
+
+var options = []option{
+	{"fenceNamespace", "FENCE_NAMESPACE", "the namespace that Fence runs in", func(s *Server) any { return &s.FenceNamespace }},
+	{"istioNamespace", "ISTIO_NAMESPACE", "the namespace that Istio runs in", func(s *Server) any { return &s.IstioNamespace }},
+	{"probePort", "PROBE_PORT", "the health check port", func(s *Server) any { return &s.ProbePort }},
+	{"wormholePort", "WORMHOLE_PORT", "the port fence-proxy always listens on", func(s *Server) any { return &s.WormholePort }},
+	{"autoFence", "AUTO_FENCE", "manage the Sidecars of the namespaces without fence label", func(s *Server) any { return &s.AutoFence }},
+	{"excludeNamespaces", "EXCLUDE_NAMESPACES", "the comma separated patterns of the namespaces left alone by Fence, along with its own and the Istio namespace: globs, or regular expressions between slashes", func(s *Server) any { return &s.ExcludeNamespaces }},
+	{"includeNamespaces", "INCLUDE_NAMESPACES", "the comma separated patterns of the only namespaces managed by Fence, empty means all", func(s *Server) any { return &s.IncludeNamespaces }},
+	{"namespaceSelector", "NAMESPACE_SELECTOR", "the label selector of the namespaces managed by Fence, empty means all", func(s *Server) any { return &s.NamespaceSelector }},
+	{"logSourcePort", "LOG_SOURCE_PORT", "the access log service port", func(s *Server) any { return &s.LogSourcePort }},
+	{"graphPort", "GRAPH_PORT", "the dependency graph export port", func(s *Server) any { return &s.GraphPort }},
+	{"metricsPort", "METRICS_PORT", "the Prometheus metrics port", func(s *Server) any { return &s.MetricsPort }},
+	{"hostTTL", "HOST_TTL", "how long a learned egress host may stay unused before it is pruned, 0 disables pruning", func(s *Server) any { return &s.HostTTL }},
+	{"pruneInterval", "PRUNE_INTERVAL", "the interval between two pruning passes", func(s *Server) any { return &s.PruneInterval }},
+	{"maxExternalDestinations", "MAX_EXTERNAL_DESTINATIONS", "the maximum number of external destinations in the dependency graph, the least recently seen are evicted first, 0 means no limit", func(s *Server) any { return &s.MaxExternalDestinations }},
+	{"dependencyStore", "DEPENDENCY_STORE", "where the learned dependencies are persisted: none/configmap/file", func(s *Server) any { return &s.DependencyStore }},
+	{"dependencyStorePath", "DEPENDENCY_STORE_PATH", "the path of the file dependency store", func(s *Server) any { return &s.DependencyStorePath }},
+	{"dependencySaveInterval", "DEPENDENCY_SAVE_INTERVAL", "the interval between two saves of the learned dependencies", func(s *Server) any { return &s.DependencySaveInterval }},
+	{"proposalInterval", "PROPOSAL_INTERVAL", "the interval between two updates of the Sidecars proposed in learning mode", func(s *Server) any { return &s.ProposalInterval }},
+	{"sidecarBatchInterval", "SIDECAR_BATCH_INTERVAL", "the interval between two writes of the learned destinations", func(s *Server) any { return &s.SidecarBatchInterval }},
+	{"sidecarWriteQPS", "SIDECAR_WRITE_QPS", "the rate of the Sidecar updates", func(s *Server) any { return &s.SidecarWriteQPS }},
+	{"sidecarWriteBurst", "SIDECAR_WRITE_BURST", "the burst of the Sidecar updates", func(s *Server) any { return &s.SidecarWriteBurst }},
+	{"accessLogQueueSize", "ACCESSLOG_QUEUE_SIZE", "the number of access log messages queued for the workers", func(s *Server) any { return &s.AccessLogQueueSize }},
+	{"accessLogWorkers", "ACCESSLOG_WORKERS", "the number of access log workers", func(s *Server) any { return &s.AccessLogWorkers }},
+	{"proxyMaxDestinations", "PROXY_MAX_DESTINATIONS", "the maximum number of original destinations of the wormhole proxy, 0 means no limit", func(s *Server) any { return &s.ProxyMaxDestinations }},
+	{"proxyMaxIdleConnsPerDestination", "PROXY_MAX_IDLE_CONNS_PER_DESTINATION", "the maximum number of idle connections per original destination", func(s *Server) any { return &s.ProxyMaxIdleConnsPerDestination }},
+	{"proxyMaxConnsPerDestination", "PROXY_MAX_CONNS_PER_DESTINATION", "the maximum number of connections per original destination, 0 means no limit", func(s *Server) any { return &s.ProxyMaxConnsPerDestination }},
+	{"proxyIdleTimeout", "PROXY_IDLE_TIMEOUT", "how long idle connections are kept by the wormhole proxy", func(s *Server) any { return &s.ProxyIdleTimeout }},
+	{"proxyFlushInterval", "PROXY_FLUSH_INTERVAL", "how often the wormhole proxy flushes the responses, 0 flushes only at the end", func(s *Server) any { return &s.ProxyFlushInterval }},
+	{"proxyDrainTimeout", "PROXY_DRAIN_TIMEOUT", "how long a closed wormhole listener serves the requests in flight", func(s *Server) any { return &s.ProxyDrainTimeout }},
+	{"logLevel", "LOG_LEVEL", "the log level: debug/info/warn/error", func(s *Server) any { return &s.LogLevel }},
+}
+
+// flag returns the name of the flag of the option, e.g. host-ttl for hostTTL.
+func (o option) flag() string {
+	var b strings.Builder
+	runes := []rune(o.name)
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 && unicode.IsLower(runes[i-1]) {
+			b.WriteByte('-')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// set parses value into the field ptr.
+func set(ptr any, value string) error {
+	switch p := ptr.(type) {
+	case *string:
+		*p = value
+	case *bool:
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*p = v
+	case *int:
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*p = v
+	case *time.Duration:
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*p = v
+	case *[]string:
+		*p = []string{}
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				*p = append(*p, v)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported type %T", ptr)
+	}
+	return nil
+}
+
+// Flags binds the configuration to the flags of a command.
+type Flags struct {
+	path  string
+	flags *pflag.FlagSet
+}
+
+// AddFlags adds the --config flag, and a flag per option, to fs.
+func AddFlags(fs *pflag.FlagSet) *Flags {
+	f := &Flags{flags: fs}
+	fs.StringVar(&f.path, "config", "", "path of the configuration file")
+
+	defaults := Default()
+	for _, o := range options {
+		usage := fmt.Sprintf("%v (env %v)", o.usage, o.env)
+		switch p := o.field(&defaults).(type) {
+		case *string:
+			fs.String(o.flag(), *p, usage)
+		case *bool:
+			fs.Bool(o.flag(), *p, usage)
+		case *int:
+			fs.Int(o.flag(), *p, usage)
+		case *time.Duration:
+			fs.Duration(o.flag(), *p, usage)
+		case *[]string:
+			fs.StringSlice(o.flag(), *p, usage)
+		}
+	}
+	return f
+}
+
+// Load returns the configuration merged from the defaults, the configuration file, the
+// environment variables and the flags, in increasing order of precedence. Invalid values fail.
+func (f *Flags) Load() (Server, error) {
+	s, err := f.merge()
+	if err != nil {
+		return s, err
+	}
+	s.Logger = logging.DefaultLogger(logging.LogLevel(s.LogLevel))
+	s.live = &Live{current: s}
+	s.live.current.live = s.live
+	return s, nil
+}
+
+func (f *Flags) merge() (Server, error) {
+	s := Default()
+	if f.path != "" {
+		if err := loadFile(&s, f.path); err != nil {
+			return s, err
+		}
+	}
+	for _, o := range options {
+		if value, ok := os.LookupEnv(o.env); ok {
+			if err := set(o.field(&s), value); err != nil {
+				return s, fmt.Errorf("invalid environment variable %v=%q: %w", o.env, value, err)
+			}
+		}
+	}
+	var err error
+	f.flags.Visit(func(fl *pflag.Flag) {
+		for _, o := range options {
+			if o.flag() != fl.Name || err != nil {
+				continue
+			}
+			value := fl.Value.String()
+			if slice, ok := fl.Value.(pflag.SliceValue); ok {
+				value = strings.Join(slice.GetSlice(), ",")
+			}
+			err = set(o.field(&s), value)
+		}
+	})
+	if err != nil {
+		return s, err
+	}
+	if err := s.Validate(); err != nil {
+		return s, err
+	}
+	s.namespaces, err = newNamespaceScope(s)
+	return s, err
+}
+
+// loadFile sets the options of the configuration file path to s. Unknown keys are rejected.
+func loadFile(s *Server, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %w", err)
+	}
+	values, err := parseFile(data)
+	if err != nil {
+		return fmt.Errorf("invalid configuration file %v: %w", path, err)
+	}
+	for _, o := range options {
+		if value, ok := values[o.name]; ok {
+			if err := set(o.field(s), value); err != nil {
+				return fmt.Errorf("invalid configuration file %v: %v: %w", path, o.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseFile returns the options of a configuration file as strings, keyed by name.
+func parseFile(data []byte) (map[string]string, error) {
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(jsonData, &raw); err != nil {
+		return nil, err
+	}
+
+	header := struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+	}{}
+	if err := json.Unmarshal(jsonData, &header); err != nil {
+		return nil, err
+	}
+	if header.APIVersion != APIVersion || header.Kind != Kind {
+		return nil, fmt.Errorf("unsupported apiVersion %q and kind %q, expected %v %v", header.APIVersion, header.Kind, APIVersion, Kind)
+	}
+	delete(raw, "apiVersion")
+	delete(raw, "kind")
+
+	known := map[string]struct{}{}
+	for _, o := range options {
+		known[o.name] = struct{}{}
+	}
+	values := map[string]string{}
+	for name, value := range raw {
+		if _, ok := known[name]; !ok {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		var str string
+		var list []string
+		if err := json.Unmarshal(value, &str); err == nil {
+			values[name] = str
+		} else if err := json.Unmarshal(value, &list); err == nil {
+			values[name] = strings.Join(list, ",")
+		} else {
+			// numbers and booleans
+			values[name] = string(value)
+		}
+	}
+	return values, nil
+}
+
+// YAML returns the configuration file of s.
+func (s Server) YAML() ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "apiVersion: %v\nkind: %v\n", APIVersion, Kind)
+	for _, o := range options {
+		var value any
+		switch p := o.field(&s).(type) {
+		case *string:
+			value = *p
+		case *bool:
+			value = *p
+		case *int:
+			value = *p
+		case *time.Duration:
+			value = p.String()
+		case *[]string:
+			value = *p
+		}
+		data, err := yaml.Marshal(map[string]any{o.name: value})
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
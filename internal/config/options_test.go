@@ -0,0 +1,173 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// newFlags returns the Flags of args, with the configuration file file if it is not empty.
+func newFlags(t *testing.T, file string, args ...string) *Flags {
+	t.Helper()
+	fs := pflag.NewFlagSet("fence", pflag.ContinueOnError)
+	f := AddFlags(fs)
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		args = append(args, "--config", path)
+	}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+const fileHeader = "apiVersion: fence.io/v1alpha1\nkind: FenceConfig\n"
+
+func TestFlagsMergePrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{name: "default", want: "info"},
+		{name: "file over default", file: fileHeader + "logLevel: warn\n", want: "warn"},
+		{name: "env over file", file: fileHeader + "logLevel: warn\n", env: map[string]string{"LOG_LEVEL": "error"}, want: "error"},
+		{name: "flag over env", file: fileHeader + "logLevel: warn\n", env: map[string]string{"LOG_LEVEL": "error"}, args: []string{"--log-level", "debug"}, want: "debug"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			s, err := newFlags(t, tt.file, tt.args...).merge()
+			if err != nil {
+				t.Fatalf("merge() error = %v", err)
+			}
+			if s.LogLevel != tt.want {
+				t.Errorf("LogLevel = %q, want %q", s.LogLevel, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlagsMergeTypes(t *testing.T) {
+	t.Setenv("EXCLUDE_NAMESPACES", "kube-system, knative-*")
+	t.Setenv("HOST_TTL", "1h")
+	file := fileHeader + "autoFence: false\nsidecarWriteQPS: 5\nincludeNamespaces: [default, /^team-/]\n"
+	s, err := newFlags(t, file, "--proxy-max-destinations", "7").merge()
+	if err != nil {
+		t.Fatalf("merge() error = %v", err)
+	}
+	if s.AutoFence {
+		t.Errorf("AutoFence = true, want false")
+	}
+	if s.SidecarWriteQPS != 5 {
+		t.Errorf("SidecarWriteQPS = %v, want 5", s.SidecarWriteQPS)
+	}
+	if want := []string{"default", "/^team-/"}; !reflect.DeepEqual(s.IncludeNamespaces, want) {
+		t.Errorf("IncludeNamespaces = %v, want %v", s.IncludeNamespaces, want)
+	}
+	if want := []string{"kube-system", "knative-*"}; !reflect.DeepEqual(s.ExcludeNamespaces, want) {
+		t.Errorf("ExcludeNamespaces = %v, want %v", s.ExcludeNamespaces, want)
+	}
+	if s.HostTTL != time.Hour {
+		t.Errorf("HostTTL = %v, want 1h", s.HostTTL)
+	}
+	if s.ProxyMaxDestinations != 7 {
+		t.Errorf("ProxyMaxDestinations = %v, want 7", s.ProxyMaxDestinations)
+	}
+}
+
+func TestFlagsMergeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{name: "unknown file key", file: fileHeader + "logLevl: debug\n", want: `unknown field "logLevl"`},
+		{name: "wrong apiVersion", file: "apiVersion: fence.io/v1\nkind: FenceConfig\n", want: "unsupported apiVersion"},
+		{name: "wrong kind", file: "apiVersion: fence.io/v1alpha1\nkind: Config\n", want: "unsupported apiVersion"},
+		{name: "missing header", file: "logLevel: debug\n", want: "unsupported apiVersion"},
+		{name: "bad file value", file: fileHeader + "hostTTL: 1 hour\n", want: "hostTTL"},
+		{name: "bad env value", env: map[string]string{"SIDECAR_WRITE_QPS": "ten"}, want: "SIDECAR_WRITE_QPS"},
+		{name: "bad env bool", env: map[string]string{"AUTO_FENCE": "maybe"}, want: "AUTO_FENCE"},
+		{name: "invalid value", args: []string{"--log-level", "verbose"}, want: "logLevel"},
+		{name: "port taken", args: []string{"--graph-port", "8084"}, want: "metricsPort: port 8084 is taken by graphPort"},
+		{name: "not positive", env: map[string]string{"ACCESSLOG_WORKERS": "0"}, want: "accessLogWorkers: must be positive"},
+		{name: "negative", args: []string{"--host-ttl", "-1s"}, want: "hostTTL: must not be negative"},
+		{name: "file store without path", args: []string{"--dependency-store", "file", "--dependency-store-path", ""}, want: "dependencyStorePath"},
+		{name: "unknown store", args: []string{"--dependency-store", "etcd"}, want: "dependencyStore"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			_, err := newFlags(t, tt.file, tt.args...).merge()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("merge() error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestYAMLRoundTrip(t *testing.T) {
+	want := Default()
+	want.AutoFence = false
+	want.ExcludeNamespaces = []string{"kube-system", "/^knative-/"}
+	want.IncludeNamespaces = []string{}
+	want.NamespaceSelector = "team=payments"
+	want.HostTTL = 90 * time.Minute
+	want.SidecarWriteQPS = 3
+	want.LogLevel = "debug"
+
+	data, err := want.YAML()
+	if err != nil {
+		t.Fatalf("YAML() error = %v", err)
+	}
+	values, err := parseFile(data)
+	if err != nil {
+		t.Fatalf("parseFile() error = %v", err)
+	}
+	if len(values) != len(options) {
+		t.Errorf("parseFile() = %v options, want %v", len(values), len(options))
+	}
+	got, err := newFlags(t, string(data)).merge()
+	if err != nil {
+		t.Fatalf("merge() error = %v", err)
+	}
+	for _, o := range options {
+		if g, w := o.field(&got), o.field(&want); !reflect.DeepEqual(g, w) {
+			t.Errorf("%v = %v, want %v", o.name, reflect.ValueOf(g).Elem(), reflect.ValueOf(w).Elem())
+		}
+	}
+}
+
+func TestOptionFlag(t *testing.T) {
+	tests := map[string]string{
+		"hostTTL":              "host-ttl",
+		"sidecarWriteQPS":      "sidecar-write-qps",
+		"logSourcePort":        "log-source-port",
+		"accessLogQueueSize":   "access-log-queue-size",
+		"fenceNamespace":       "fence-namespace",
+		"autoFence":            "auto-fence",
+		"proxyMaxDestinations": "proxy-max-destinations",
+	}
+	for name, want := range tests {
+		if got := (option{name: name}).flag(); got != want {
+			t.Errorf("flag(%v) = %v, want %v", name, got, want)
+		}
+	}
+}
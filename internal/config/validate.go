@@ -0,0 +1,100 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hexiaodai/fence/internal/logging"
+)
+
+// Validate returns the invalid options of s, if any.
+func (s Server) Validate() error {
+	errs := []error{}
+
+	if s.FenceNamespace == "" {
+		errs = append(errs, fmt.Errorf("fenceNamespace: must not be empty"))
+	}
+	if s.IstioNamespace == "" {
+		errs = append(errs, fmt.Errorf("istioNamespace: must not be empty"))
+	}
+
+	ports := map[string]string{}
+	for _, p := range []struct{ name, value string }{
+		{"probePort", s.ProbePort},
+		{"logSourcePort", s.LogSourcePort},
+		{"graphPort", s.GraphPort},
+		{"metricsPort", s.MetricsPort},
+		{"wormholePort", s.WormholePort},
+	} {
+		if port, err := strconv.Atoi(p.value); err != nil || port < 1 || port > 65535 {
+			errs = append(errs, fmt.Errorf("%v: %q is not a valid port", p.name, p.value))
+			continue
+		}
+		if other, ok := ports[p.value]; ok {
+			errs = append(errs, fmt.Errorf("%v: port %v is taken by %v", p.name, p.value, other))
+			continue
+		}
+		ports[p.value] = p.name
+	}
+
+	switch s.DependencyStore {
+	case "none", "configmap":
+	case "file":
+		if s.DependencyStorePath == "" {
+			errs = append(errs, fmt.Errorf("dependencyStorePath: must not be empty with the file dependency store"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("dependencyStore: %q is not one of none/configmap/file", s.DependencyStore))
+	}
+
+	if _, err := newNamespaceScope(s); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch logging.LogLevel(s.LogLevel) {
+	case logging.LogLevelDebug, logging.LogLevelInfo, logging.LogLevelWarn, logging.LogLevelError:
+	default:
+		errs = append(errs, fmt.Errorf("logLevel: %q is not one of debug/info/warn/error", s.LogLevel))
+	}
+
+	for _, v := range []struct {
+		name  string
+		value int64
+	}{
+		{"pruneInterval", int64(s.PruneInterval)},
+		{"dependencySaveInterval", int64(s.DependencySaveInterval)},
+		{"proposalInterval", int64(s.ProposalInterval)},
+		{"sidecarBatchInterval", int64(s.SidecarBatchInterval)},
+		{"sidecarWriteQPS", int64(s.SidecarWriteQPS)},
+		{"sidecarWriteBurst", int64(s.SidecarWriteBurst)},
+		{"accessLogQueueSize", int64(s.AccessLogQueueSize)},
+		{"accessLogWorkers", int64(s.AccessLogWorkers)},
+	} {
+		if v.value <= 0 {
+			errs = append(errs, fmt.Errorf("%v: must be positive", v.name))
+		}
+	}
+	for _, v := range []struct {
+		name  string
+		value int64
+	}{
+		{"hostTTL", int64(s.HostTTL)},
+		{"maxExternalDestinations", int64(s.MaxExternalDestinations)},
+		{"proxyMaxDestinations", int64(s.ProxyMaxDestinations)},
+		{"proxyMaxIdleConnsPerDestination", int64(s.ProxyMaxIdleConnsPerDestination)},
+		{"proxyMaxConnsPerDestination", int64(s.ProxyMaxConnsPerDestination)},
+		{"proxyIdleTimeout", int64(s.ProxyIdleTimeout)},
+		{"proxyFlushInterval", int64(s.ProxyFlushInterval)},
+		{"proxyDrainTimeout", int64(s.ProxyDrainTimeout)},
+	} {
+		if v.value < 0 {
+			errs = append(errs, fmt.Errorf("%v: must not be negative", v.name))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/hexiaodai/fence/internal/cache"
+	"github.com/hexiaodai/fence/internal/config"
+	"github.com/hexiaodai/fence/internal/store"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// DependencySaver periodically saves the learned dependency graph to the store,
+// and once more when the controller shuts down.
+type DependencySaver struct {
+	config.Server
+	store           store.Store
+	dependencyCache *cache.Dependency
+	// savedGeneration is the generation of the dependency graph which was saved last.
+	savedGeneration uint64
+}
+
+func NewDependencySaver(store store.Store, dependencyCache *cache.Dependency, server config.Server) *DependencySaver {
+	server.Logger = server.Logger.WithName("Save").WithValues("controller", "DependencySaver")
+	return &DependencySaver{
+		store:           store,
+		dependencyCache: dependencyCache,
+		Server:          server,
+	}
+}
+
+func (s *DependencySaver) Start(ctx context.Context) error {
+	s.Logger.Info("started", "dependencySaveInterval", s.DependencySaveInterval)
+	wait.UntilWithContext(ctx, s.save, s.DependencySaveInterval)
+
+	saveCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s.save(saveCtx)
+	return nil
+}
+
+func (s *DependencySaver) save(ctx context.Context) {
+	generation := s.dependencyCache.Generation()
+	if generation == s.savedGeneration {
+		return
+	}
+	records := s.dependencyCache.Records()
+	if err := s.store.Save(ctx, records); err != nil {
+		s.Logger.Error(err, "failed to save dependencies")
+		return
+	}
+	s.savedGeneration = generation
+	s.Logger.Sugar().Debugw("dependencies saved", "dependencies", len(records))
+}
@@ -0,0 +1,180 @@
+package controller
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hexiaodai/fence/internal/config"
+	iistio "github.com/hexiaodai/fence/internal/istio"
+	"github.com/hexiaodai/fence/internal/monitoring"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// maxBatchRetries is the number of times a failed update is retried before its destinations are dropped.
+const maxBatchRetries = 5
+
+// DestinationBatcher coalesces the destinations learned from the access log stream, and writes
+// them every SidecarBatchInterval, with one update per Sidecar, or per fence-proxy EnvoyFilter
+// for the external destinations. A burst of requests between the same services results in a
+// single write, if any. Failed updates are retried with backoff.
+type DestinationBatcher struct {
+	config.Server
+	resource *Resource
+	limiter  flowcontrol.RateLimiter
+	queue    workqueue.RateLimitingInterface
+
+	mu sync.Mutex
+	// pending holds the destinations to write to each object on the next update
+	pending map[batchKey]map[string]struct{}
+}
+
+// batchKey is the object the destinations are written to. The destinations are kept apart by
+// protocol, for the metrics.
+type batchKey struct {
+	types.NamespacedName
+	protocol string
+	// external is true for the fence-proxy EnvoyFilter of a port, false for a Sidecar
+	external bool
+	port     int32
+}
+
+func NewDestinationBatcher(resource *Resource, server config.Server) *DestinationBatcher {
+	server.Logger = server.Logger.WithName("Batch").WithValues("controller", "DestinationBatcher")
+	return &DestinationBatcher{
+		resource: resource,
+		limiter:  flowcontrol.NewTokenBucketRateLimiter(float32(server.SidecarWriteQPS), server.SidecarWriteBurst),
+		queue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "fence-destinations"),
+		pending:  map[batchKey]map[string]struct{}{},
+		Server:   server,
+	}
+}
+
+// AddHost queues destSvc, learned from an access log of protocol, to be added to the Sidecar nn.
+func (b *DestinationBatcher) AddHost(protocol string, nn types.NamespacedName, destSvc string) {
+	b.add(batchKey{NamespacedName: nn, protocol: protocol}, destSvc)
+}
+
+// AddExternalHost queues authority to be routed through fence-proxy on port.
+func (b *DestinationBatcher) AddExternalHost(port int32, authority string) {
+	nn := types.NamespacedName{Namespace: b.IstioNamespace, Name: iistio.FenceProxyEnvoyFilterName(port)}
+	b.add(batchKey{NamespacedName: nn, protocol: monitoring.ProtocolHTTP, external: true, port: port}, authority)
+}
+
+func (b *DestinationBatcher) add(key batchKey, dests ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pending, ok := b.pending[key]
+	if !ok {
+		pending = map[string]struct{}{}
+		b.pending[key] = pending
+	}
+	for _, dest := range dests {
+		pending[dest] = struct{}{}
+	}
+}
+
+// take removes the destinations pending for key.
+func (b *DestinationBatcher) take(key batchKey) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	dests := make([]string, 0, len(b.pending[key]))
+	for dest := range b.pending[key] {
+		dests = append(dests, dest)
+	}
+	delete(b.pending, key)
+	return dests
+}
+
+// NeedLeaderElection is false, every replica writes the destinations of the access logs it receives.
+func (b *DestinationBatcher) NeedLeaderElection() bool {
+	return false
+}
+
+func (b *DestinationBatcher) Start(ctx context.Context) error {
+	b.Logger.Info("started", "batchInterval", b.SidecarBatchInterval, "qps", b.SidecarWriteQPS, "burst", b.SidecarWriteBurst)
+	go func() {
+		<-ctx.Done()
+		b.queue.ShutDown()
+	}()
+	go wait.UntilWithContext(ctx, b.flush, b.SidecarBatchInterval)
+	// the updates are rate limited, a single worker is enough
+	for b.processNextItem(ctx) {
+	}
+	b.limiter.Stop()
+	return nil
+}
+
+// flush queues the objects with pending destinations. The objects waiting for a retry are left
+// to their backoff, and get the destinations learned in the meantime.
+func (b *DestinationBatcher) flush(ctx context.Context) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key := range b.pending {
+		if b.queue.NumRequeues(key) > 0 {
+			continue
+		}
+		b.queue.Add(key)
+	}
+}
+
+func (b *DestinationBatcher) processNextItem(ctx context.Context) bool {
+	item, shutdown := b.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer b.queue.Done(item)
+	key := item.(batchKey)
+
+	dests := b.take(key)
+	if len(dests) == 0 {
+		b.queue.Forget(key)
+		return true
+	}
+	if err := b.limiter.Wait(ctx); err != nil {
+		return false
+	}
+
+	err := b.write(ctx, key, dests)
+	if err == nil {
+		b.queue.Forget(key)
+		return true
+	}
+
+	if b.queue.NumRequeues(key) >= maxBatchRetries {
+		b.Logger.Error(err, "failed to write destinations, dropping them", "key", key, "destinations", dests)
+		monitoring.AccessLogEntriesDropped.WithLabelValues(key.protocol, dropReason(err)).Add(float64(len(dests)))
+		b.queue.Forget(key)
+		return true
+	}
+	if errors.IsConflict(err) {
+		monitoring.ConflictRetries.WithLabelValues(key.protocol).Inc()
+	}
+	b.Logger.Sugar().Debugw("failed to write destinations, retrying", "key", key, "error", err)
+	// retried along with the destinations learned in the meantime
+	b.add(key, dests...)
+	b.queue.AddRateLimited(key)
+	return true
+}
+
+// write adds dests to the object of key, in a single update.
+func (b *DestinationBatcher) write(ctx context.Context, key batchKey, dests []string) error {
+	if key.external {
+		return b.resource.AddExternalHostsToEnvoyFilter(ctx, key.port, dests...)
+	}
+	return b.resource.AddDestinationHostsToSidecar(ctx, key.NamespacedName, dests...)
+}
+
+// String returns the object of the key, for the logs.
+func (k batchKey) String() string {
+	if k.external {
+		return "envoyfilter/" + k.NamespacedName.String()
+	}
+	return "sidecar/" + k.NamespacedName.String()
+}
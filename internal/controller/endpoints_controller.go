@@ -2,7 +2,6 @@ package controller
 
 import (
 	"context"
-	goerrors "errors"
 	"fmt"
 
 	"github.com/hexiaodai/fence/internal/cache"
@@ -14,7 +13,12 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
 type EndpointsReconciler struct {
@@ -40,38 +44,35 @@ func NewEndpointsReconciler(opts ...EndpointsReconcilerOpts) *EndpointsReconcile
 func (r *EndpointsReconciler) Reconcile(ctx context.Context, request ctrl.Request) (ctrl.Result, error) {
 	log := r.Logger.WithValues("namespace", request.Namespace, "name", request.Name)
 
-	if isSystemNamespace(r.Server.FenceNamespace, r.Server.IstioNamespace, request.Namespace) {
-		log.Sugar().Debugw("skip system namespace", "namespaceName", request.NamespacedName)
-		return ctrl.Result{}, nil
-	}
-
 	instance := &corev1.Endpoints{}
 	if err := r.Client.Get(ctx, request.NamespacedName, instance); err != nil {
 		if errors.IsNotFound(err) {
-			log.Sugar().Debugw("resource not found. ignoring since object must be deleted", "namespaceName", request.NamespacedName)
-			return ctrl.Result{}, nil
+			log.Sugar().Debugw("resource not found. cleaning up since object must be deleted", "namespaceName", request.NamespacedName)
+			return ctrl.Result{}, r.cleanupDeletedService(ctx, request.NamespacedName)
 		} else {
 			return ctrl.Result{}, fmt.Errorf("failed to get endpoints: %v", err)
 		}
 	}
 
+	if excluded, err := namespaceIsExcluded(ctx, r.Client, r.Server, request.Namespace); err != nil {
+		return ctrl.Result{}, err
+	} else if excluded {
+		log.Sugar().Debugw("skip excluded namespace", "namespaceName", request.NamespacedName)
+		return ctrl.Result{}, nil
+	}
+
 	if len(instance.Subsets) == 0 {
 		log.Sugar().Debugw("endpoints subsets are empty", "namespaceName", request.NamespacedName)
 		return ctrl.Result{}, nil
 	}
 
-	svc, pod, err := r.fetchServiceAndPod(ctx, instance)
-	if err != nil {
-		if goerrors.Is(err, errNotFound) || errors.IsNotFound(err) {
-			log.Sugar().Warnw("no service and pod associated", "namespaceName", request.NamespacedName)
+	svc := &corev1.Service{}
+	if err := r.Client.Get(ctx, request.NamespacedName, svc); err != nil {
+		if errors.IsNotFound(err) {
+			log.Sugar().Warnw("no service associated", "namespaceName", request.NamespacedName)
 			return ctrl.Result{}, nil
 		}
-		return ctrl.Result{}, fmt.Errorf("failed to fetch service and pod: %v", err)
-	}
-
-	if !fenceIsEnabled(r.NamespaceCache, r.Server.AutoFence, pod) || !isInjectSidecar(pod) {
-		log.Sugar().Debugw("fence is not enabled or sidecar is not injected", "namespaceName", request.NamespacedName)
-		return ctrl.Result{}, nil
+		return ctrl.Result{}, fmt.Errorf("failed to get service: %v", err)
 	}
 
 	if err := r.Resource.RefreshByService(ctx, svc); err != nil {
@@ -84,37 +85,57 @@ func (r *EndpointsReconciler) Reconcile(ctx context.Context, request ctrl.Reques
 	return ctrl.Result{}, nil
 }
 
-var errNotFound = fmt.Errorf("resource not found")
-
-func (r *EndpointsReconciler) fetchServiceAndPod(ctx context.Context, ep *corev1.Endpoints) (svc *corev1.Service, pod *corev1.Pod, err error) {
-	if len(ep.Subsets) == 0 {
-		err = errNotFound
-		return
-	}
-	svc = &corev1.Service{}
-	pod = &corev1.Pod{}
-	if err = r.Client.Get(ctx, types.NamespacedName{Namespace: ep.Namespace, Name: ep.Name}, svc); err != nil {
-		err = fmt.Errorf("failed to get service: %w", err)
-		return
+// cleanupDeletedService removes the service from the Sidecars which depend on it,
+// once both the service and its endpoints are gone.
+func (r *EndpointsReconciler) cleanupDeletedService(ctx context.Context, nn types.NamespacedName) error {
+	if err := r.Client.Get(ctx, nn, &corev1.Service{}); err == nil {
+		return nil
+	} else if !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to get service: %v", err)
 	}
-	list := &corev1.PodList{}
-	if err = r.Client.List(ctx, list, &client.ListOptions{
-		LabelSelector: labels.Set(svc.Spec.Selector).AsSelector(),
-		Limit:         1,
-	}); err != nil {
-		err = fmt.Errorf("failed to list pod: %v", err)
-		return
+	if err := r.Resource.RemoveDestinationServiceFromSidecars(ctx, nn); err != nil {
+		return fmt.Errorf("failed to clean up deleted service. namespaceName %v. %w", nn, err)
 	}
-	if len(list.Items) == 0 {
-		err = errNotFound
-		return
-	}
-	pod = &list.Items[0]
-	return
+	return nil
 }
 
 func (r *EndpointsReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&corev1.Endpoints{}).
+		// the endpoints share the name of their service
+		Watches(&corev1.Service{}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(predicate.Funcs{
+			CreateFunc:  func(event.CreateEvent) bool { return false },
+			UpdateFunc:  func(event.UpdateEvent) bool { return false },
+			DeleteFunc:  func(event.DeleteEvent) bool { return true },
+			GenericFunc: func(event.GenericEvent) bool { return false },
+		})).
+		// the pods opting in or out do not change the endpoints
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(r.servicesOfPod), builder.WithPredicates(predicate.Funcs{
+			CreateFunc: func(event.CreateEvent) bool { return false },
+			UpdateFunc: func(e event.UpdateEvent) bool {
+				return e.ObjectOld.GetLabels()[config.SidecarFenceLabel] != e.ObjectNew.GetLabels()[config.SidecarFenceLabel]
+			},
+			DeleteFunc:  func(event.DeleteEvent) bool { return false },
+			GenericFunc: func(event.GenericEvent) bool { return false },
+		})).
 		Complete(r)
 }
+
+// servicesOfPod maps a pod to the Services which select it.
+func (r *EndpointsReconciler) servicesOfPod(ctx context.Context, obj client.Object) []reconcile.Request {
+	list := &corev1.ServiceList{}
+	if err := r.Client.List(ctx, list, client.InNamespace(obj.GetNamespace())); err != nil {
+		r.Logger.Error(err, "failed to list service")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, svc := range list.Items {
+		if len(svc.Spec.Selector) == 0 {
+			continue
+		}
+		if labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(obj.GetLabels())) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}})
+		}
+	}
+	return requests
+}
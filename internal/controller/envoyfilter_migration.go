@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	iistio "github.com/hexiaodai/fence/internal/istio"
+	"github.com/hexiaodai/fence/internal/monitoring"
+	"google.golang.org/protobuf/proto"
+	istio "istio.io/api/networking/v1alpha3"
+	networkingv1alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// MigrateFenceProxyEnvoyFilter moves the config patches of the legacy fence-proxy EnvoyFilter,
+// which held every port, to the EnvoyFilter of each port, and deletes it. The EnvoyFilters of
+// the ports which exist already get the external hosts of the legacy one.
+func (r *Resource) MigrateFenceProxyEnvoyFilter(ctx context.Context) error {
+	nn := types.NamespacedName{Namespace: r.IstioNamespace, Name: "fence-proxy"}
+	log := r.Logger.WithName(nn.String()).WithValues("function", "MigrateFenceProxyEnvoyFilter")
+
+	legacy := &networkingv1alpha3.EnvoyFilter{}
+	if err := r.Client.Get(ctx, nn, legacy); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to get envoyFilter. namespaceName %v. %w", nn, err)
+	}
+	for port, patches := range iistio.SplitFenceProxyEnvoyFilter(&legacy.Spec) {
+		envoyFilter := iistio.GenerateFenceProxyEnvoyFilter(r.IstioNamespace, port)
+		envoyFilter.Spec.ConfigPatches = patches
+		iistio.MergeFenceProxyEnvoyFilter(&envoyFilter.Spec, corev1.ServicePort{Port: port}, r.FenceNamespace)
+		if err := r.Client.Create(ctx, envoyFilter); err != nil {
+			if !errors.IsAlreadyExists(err) {
+				return fmt.Errorf("failed to create envoyFilter. namespaceName %v/%v. %w", envoyFilter.Namespace, envoyFilter.Name, err)
+			}
+			// the EnvoyFilter of the port was created since, it gets the external hosts learned before
+			if err := r.mergeLegacyExternalHosts(ctx, port, patches); err != nil {
+				return err
+			}
+			log.Info("port merged from the legacy envoyFilter", "port", port)
+			continue
+		}
+		monitoring.EnvoyFilterConfigPatches.WithLabelValues(envoyFilter.Namespace, envoyFilter.Name).Set(float64(len(envoyFilter.Spec.ConfigPatches)))
+		log.Info("port migrated from the legacy envoyFilter", "port", port)
+	}
+	if err := r.Client.Delete(ctx, legacy); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete envoyFilter. namespaceName %v. %w", nn, err)
+	}
+	monitoring.EnvoyFilterConfigPatches.DeleteLabelValues(legacy.Namespace, legacy.Name)
+	log.Info("legacy envoyFilter migrated")
+	return nil
+}
+
+// mergeLegacyExternalHosts adds the external hosts routed by the legacy patches of port to the
+// existing EnvoyFilter of port.
+func (r *Resource) mergeLegacyExternalHosts(ctx context.Context, port int32, patches []*istio.EnvoyFilter_EnvoyConfigObjectPatch) error {
+	nn := types.NamespacedName{Namespace: r.IstioNamespace, Name: iistio.FenceProxyEnvoyFilterName(port)}
+	found := &networkingv1alpha3.EnvoyFilter{}
+	if err := r.Client.Get(ctx, nn, found); err != nil {
+		return fmt.Errorf("failed to get envoyFilter. namespaceName %v. %w", nn, err)
+	}
+	spec := proto.Clone(&found.Spec)
+	for _, host := range iistio.ExternalHosts(patches, port) {
+		iistio.AddExternalServiceToRouteConfigUration(fmt.Sprintf("%v:%v", host, port), found)
+	}
+	if proto.Equal(spec, &found.Spec) {
+		return nil
+	}
+	if err := r.Client.Update(ctx, found); err != nil {
+		return fmt.Errorf("failed to update envoyFilter. namespaceName %v. %w", nn, err)
+	}
+	monitoring.EnvoyFilterConfigPatches.WithLabelValues(found.Namespace, found.Name).Set(float64(len(found.Spec.ConfigPatches)))
+	return nil
+}
@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hexiaodai/fence/internal/config"
+	iistio "github.com/hexiaodai/fence/internal/istio"
+	networkingv1alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestMigrateFenceProxyEnvoyFilter(t *testing.T) {
+	server := config.Default()
+	// the legacy EnvoyFilter routes ports 9080 and 8080, with an external host learned on each
+	legacy := iistio.GenerateFenceProxyEnvoyFilter(server.IstioNamespace, 0)
+	legacy.Name = "fence-proxy"
+	for _, port := range []int32{9080, 8080} {
+		iistio.MergeFenceProxyEnvoyFilter(&legacy.Spec, corev1.ServicePort{Port: port}, server.FenceNamespace)
+	}
+	iistio.AddExternalServiceToRouteConfigUration("legacy.example.com:9080", legacy)
+	iistio.AddExternalServiceToRouteConfigUration("legacy.example.com:8080", legacy)
+	// the EnvoyFilter of port 9080 was created since, with an external host of its own
+	existing := iistio.GenerateFenceProxyEnvoyFilter(server.IstioNamespace, 9080)
+	iistio.MergeFenceProxyEnvoyFilter(&existing.Spec, corev1.ServicePort{Port: 9080}, server.FenceNamespace)
+	iistio.AddExternalServiceToRouteConfigUration("new.example.com:9080", existing)
+
+	scheme := runtime.NewScheme()
+	_ = networkingv1alpha3.AddToScheme(scheme)
+	r := &Resource{
+		Server: server,
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(legacy, existing).Build(),
+	}
+	ctx := context.Background()
+	if err := r.MigrateFenceProxyEnvoyFilter(ctx); err != nil {
+		t.Fatalf("MigrateFenceProxyEnvoyFilter() error = %v", err)
+	}
+
+	for port, want := range map[int32][]string{9080: {"new.example.com", "legacy.example.com"}, 8080: {"legacy.example.com"}} {
+		found := &networkingv1alpha3.EnvoyFilter{}
+		if err := r.Client.Get(ctx, types.NamespacedName{Namespace: server.IstioNamespace, Name: iistio.FenceProxyEnvoyFilterName(port)}, found); err != nil {
+			t.Fatalf("Get(%v) error = %v", iistio.FenceProxyEnvoyFilterName(port), err)
+		}
+		if got := iistio.ExternalHosts(found.Spec.ConfigPatches, port); !reflect.DeepEqual(got, want) {
+			t.Errorf("ExternalHosts(%v) = %v, want %v", found.Name, got, want)
+		}
+	}
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: server.IstioNamespace, Name: "fence-proxy"}, &networkingv1alpha3.EnvoyFilter{})
+	if !errors.IsNotFound(err) {
+		t.Errorf("Get(fence-proxy) error = %v, want it deleted", err)
+	}
+}
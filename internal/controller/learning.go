@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hexiaodai/fence/api/v1alpha1"
+	"github.com/hexiaodai/fence/internal/config"
+	iistio "github.com/hexiaodai/fence/internal/istio"
+	networkingv1alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/yaml"
+)
+
+// ProposalKey is the key of the proposed Sidecar in the proposal ConfigMap.
+const ProposalKey = "sidecar.yaml"
+
+// ProposalName returns the name of the ConfigMap holding the Sidecar proposed for a workload
+// in learning mode.
+func ProposalName(workload string) string {
+	return fmt.Sprintf("fence-proposal-%v", workload)
+}
+
+// learningWorkload is a workload in learning mode.
+type learningWorkload struct {
+	workload
+	policy      *v1alpha1.FencePolicySpec
+	envoyFilter *networkingv1alpha3.EnvoyFilter
+}
+
+// learnWorkload collects the outbound access logs of the workload instead of restricting its
+// egress, and proposes the Sidecar it would get in enforcing mode.
+func (r *Resource) learnWorkload(ctx context.Context, w workload, policy *v1alpha1.FencePolicySpec) error {
+	log := r.Logger.WithName(w.String()).WithValues("function", "learnWorkload")
+
+	envoyFilter, err := r.sidecar.GenerateLearningEnvoyFilter(w.NamespacedName, w.selector)
+	if err != nil {
+		return err
+	}
+	services, err := r.servicesOfWorkload(ctx, w)
+	if err != nil {
+		return err
+	}
+	if err := r.setServiceOwners(envoyFilter, services); err != nil {
+		return err
+	}
+	if err := r.Client.Create(ctx, envoyFilter); err != nil {
+		if !errors.IsAlreadyExists(err) {
+			return err
+		}
+		found := &networkingv1alpha3.EnvoyFilter{}
+		if err := r.Client.Get(ctx, types.NamespacedName{Namespace: envoyFilter.Namespace, Name: envoyFilter.Name}, found); err != nil {
+			return err
+		}
+		found.OwnerReferences = envoyFilter.OwnerReferences
+		found.Spec.WorkloadSelector = envoyFilter.Spec.WorkloadSelector
+		found.Spec.ConfigPatches = envoyFilter.Spec.ConfigPatches
+		if err := r.Client.Update(ctx, found); err != nil {
+			return err
+		}
+		envoyFilter = found
+	} else {
+		log.Sugar().Infow("workload is in learning mode", "namespaceName", w.NamespacedName)
+	}
+
+	lw := learningWorkload{workload: w, policy: policy, envoyFilter: envoyFilter}
+	r.learning.Store(w.NamespacedName, lw)
+	return r.writeProposal(ctx, lw)
+}
+
+// promoteWorkload stops learning the workload. Its proposal is garbage collected along with
+// the learning EnvoyFilter.
+func (r *Resource) promoteWorkload(ctx context.Context, nn types.NamespacedName) error {
+	found := &networkingv1alpha3.EnvoyFilter{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: nn.Namespace, Name: iistio.LearningEnvoyFilterName(nn.Name)}, found); err != nil {
+		if errors.IsNotFound(err) {
+			r.learning.Delete(nn)
+			return nil
+		}
+		return err
+	}
+	if err := r.Client.Delete(ctx, found); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	r.learning.Delete(nn)
+	r.proposals.Delete(nn)
+	r.Logger.Sugar().Infow("workload promoted to enforcing mode", "function", "promoteWorkload", "namespaceName", nn)
+	return nil
+}
+
+// writeProposal writes the Sidecar proposed for the workload, with the destinations learned so far.
+func (r *Resource) writeProposal(ctx context.Context, lw learningWorkload) error {
+	nn := lw.NamespacedName
+
+	proposal, err := r.sidecar.Generate(nn, lw.selector)
+	if err != nil {
+		return err
+	}
+	proposal.TypeMeta = metav1.TypeMeta{APIVersion: networkingv1alpha3.SchemeGroupVersion.String(), Kind: "Sidecar"}
+	r.sidecar.AddHostsToEgress(proposal, r.learnedHosts(nn, lw.policy)...)
+	r.applyPolicyToSidecar(proposal, lw.policy)
+	data, err := yaml.Marshal(proposal)
+	if err != nil {
+		return err
+	}
+	if written, ok := r.proposals.Load(nn); ok && written.(string) == string(data) {
+		return nil
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ProposalName(nn.Name),
+			Namespace: nn.Namespace,
+			Labels: map[string]string{
+				config.ManagedByLabel: config.ManagedByValue,
+			},
+		},
+		Data: map[string]string{ProposalKey: string(data)},
+	}
+	if err := controllerutil.SetControllerReference(lw.envoyFilter, cm, r.scheme); err != nil {
+		return err
+	}
+	// the proposals are not cached, they are overwritten
+	if err := r.Client.Update(ctx, cm); err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		if err := r.Client.Create(ctx, cm); err != nil {
+			return err
+		}
+	}
+	r.proposals.Store(nn, string(data))
+	r.Logger.Sugar().Debugw("sidecar proposal written", "function", "writeProposal", "namespaceName", nn)
+	return nil
+}
+
+// WriteProposals rewrites the proposals of every workload in learning mode.
+func (r *Resource) WriteProposals(ctx context.Context) {
+	r.learning.Range(func(key, value any) bool {
+		if err := r.writeProposal(ctx, value.(learningWorkload)); err != nil {
+			r.Logger.Error(err, "failed to write sidecar proposal", "namespaceName", key)
+		}
+		return true
+	})
+}
+
+// learnedHosts returns the egress hosts of the services learned for the workload nn.
+func (r *Resource) learnedHosts(nn types.NamespacedName, policy *v1alpha1.FencePolicySpec) []string {
+	hosts := []string{}
+	for _, destination := range r.dependencyCache.Destinations(nn) {
+		// external destinations are routed by fence-proxy, not by the Sidecar
+		if !strings.HasSuffix(destination, ".svc.cluster.local") {
+			continue
+		}
+		if isExcludedDestination(policy, destination) {
+			continue
+		}
+		hosts = append(hosts, iistio.EgressHost(destination))
+	}
+	return hosts
+}
@@ -4,26 +4,30 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 
 	data_accesslog "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
 	"github.com/hexiaodai/fence/internal/cache"
 	"github.com/hexiaodai/fence/internal/config"
 	iistio "github.com/hexiaodai/fence/internal/istio"
+	"github.com/hexiaodai/fence/internal/monitoring"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/client-go/util/retry"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type LogEntry struct {
 	config.Server
 	client.Client
-	sidecar        *iistio.Sidecar
-	namespaceCache *cache.Namespace
-	ipServiceCache *cache.IpService
-	resource       *Resource
-	scheme         *runtime.Scheme
+	sidecar         *iistio.Sidecar
+	namespaceCache  *cache.Namespace
+	ipServiceCache  *cache.IpService
+	dependencyCache *cache.Dependency
+	resource        *Resource
+	batcher         *DestinationBatcher
+	scheme          *runtime.Scheme
 }
 
 type HTTPAccessLogEntryWrapper struct {
@@ -39,16 +43,18 @@ const (
 	External
 )
 
-func NewLogEntry(client client.Client, scheme *runtime.Scheme, sidecar *iistio.Sidecar, namespaceCache *cache.Namespace, ipServiceCache *cache.IpService, resource *Resource, server config.Server) *LogEntry {
+func NewLogEntry(client client.Client, scheme *runtime.Scheme, sidecar *iistio.Sidecar, namespaceCache *cache.Namespace, ipServiceCache *cache.IpService, dependencyCache *cache.Dependency, resource *Resource, batcher *DestinationBatcher, server config.Server) *LogEntry {
 	server.Logger = server.Logger.WithName("StreamLogEntry").WithValues("controller", "LogEntry")
 	return &LogEntry{
-		Client:         client,
-		scheme:         scheme,
-		sidecar:        sidecar,
-		namespaceCache: namespaceCache,
-		ipServiceCache: ipServiceCache,
-		resource:       resource,
-		Server:         server,
+		Client:          client,
+		scheme:          scheme,
+		sidecar:         sidecar,
+		namespaceCache:  namespaceCache,
+		ipServiceCache:  ipServiceCache,
+		dependencyCache: dependencyCache,
+		resource:        resource,
+		batcher:         batcher,
+		Server:          server,
 	}
 }
 
@@ -59,13 +65,18 @@ func (l *LogEntry) StreamLogEntry(logEntrys []*data_accesslog.HTTPAccessLogEntry
 		if err != nil {
 			sourceIp, _ := l.ipServiceCache.FetchSourceIp(entry)
 			l.Logger.Error(err, "failed to get sidecar namespaceName", "source ip", sourceIp)
+			monitoring.AccessLogEntriesDropped.WithLabelValues(monitoring.ProtocolHTTP, monitoring.ReasonNoSource).Inc()
 			continue
 		}
 
-		log := l.Logger.WithValues("namespace", nn.Namespace, "service", nn.Name)
+		log := l.Logger.WithValues("namespace", nn.Namespace, "workload", nn.Name)
 
-		if isSystemNamespace(l.FenceNamespace, l.IstioNamespace, nn.Namespace) {
-			log.Sugar().Debugw("skip system namespace", "namespaceName", nn)
+		if excluded, err := namespaceIsExcluded(context.Background(), l.Client, l.Server, nn.Namespace); err != nil || excluded {
+			if err != nil {
+				log.Error(err, "failed to get namespace", "namespaceName", nn)
+			}
+			log.Sugar().Debugw("skip excluded namespace", "namespaceName", nn)
+			monitoring.AccessLogEntriesDropped.WithLabelValues(monitoring.ProtocolHTTP, monitoring.ReasonExcludedNamespace).Inc()
 			continue
 		}
 
@@ -75,31 +86,106 @@ func (l *LogEntry) StreamLogEntry(logEntrys []*data_accesslog.HTTPAccessLogEntry
 			HTTPAccessLogEntry: entry,
 		}
 
-		retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-			return l.resource.RefreshByHTTPAccessLogEntryWrapper(context.Background(), entryWrapper)
-		})
-		if retryErr != nil {
-			l.Logger.Error(retryErr, "failed to update sidecar, exceeded the maximum number of conflict retries", "namespaceName", nn)
+		if dest, err := l.destination(entryWrapper); err == nil {
+			l.dependencyCache.Record(nn, dest, entry.GetResponse().GetResponseCode().GetValue())
+		} else {
+			log.Sugar().Debugw("skip record dependency", "namespaceName", nn, "error", err)
+		}
+
+		if isOutboundEntry(entry) {
+			// the outbound access logs come from the workloads in learning mode, which have no Sidecar.
+			monitoring.AccessLogEntriesProcessed.WithLabelValues(monitoring.ProtocolHTTP).Inc()
+			continue
+		}
+
+		if entryWrapper.DestinationService == Internal {
+			destSvc, err := l.sidecar.DestinationSvc(entry)
+			if err != nil {
+				log.Sugar().Debugw("skip access log without destination service", "namespaceName", nn, "error", err)
+				monitoring.AccessLogEntriesDropped.WithLabelValues(monitoring.ProtocolHTTP, monitoring.ReasonNoDestination).Inc()
+				continue
+			}
+			l.batcher.AddHost(monitoring.ProtocolHTTP, nn, destSvc)
+			monitoring.AccessLogEntriesProcessed.WithLabelValues(monitoring.ProtocolHTTP).Inc()
 			continue
 		}
+
+		port, err := strconv.ParseInt(cache.AuthorityPort(entry.GetRequest().GetAuthority()), 10, 32)
+		if err != nil {
+			log.Sugar().Debugw("skip access log with invalid authority", "namespaceName", nn, "error", err)
+			monitoring.AccessLogEntriesDropped.WithLabelValues(monitoring.ProtocolHTTP, monitoring.ReasonNoDestination).Inc()
+			continue
+		}
+		l.batcher.AddExternalHost(int32(port), entry.GetRequest().GetAuthority())
+		monitoring.AccessLogEntriesProcessed.WithLabelValues(monitoring.ProtocolHTTP).Inc()
 	}
 }
 
+// StreamTCPLogEntry adds the destination services of TCP connections, e.g. databases and
+// message queues, to the Sidecar of the source service.
+func (l *LogEntry) StreamTCPLogEntry(logEntrys []*data_accesslog.TCPAccessLogEntry) {
+	for _, entry := range logEntrys {
+		l.Logger.Sugar().Debugw("StreamTCPLogEntry", "TCPAccessLogEntry", entry)
+		nn, err := l.getNamespacedNameFromCommon(entry.GetCommonProperties())
+		if err != nil {
+			l.Logger.Sugar().Debugw("skip tcp access log without source service", "error", err)
+			monitoring.AccessLogEntriesDropped.WithLabelValues(monitoring.ProtocolTCP, monitoring.ReasonNoSource).Inc()
+			continue
+		}
+
+		log := l.Logger.WithValues("namespace", nn.Namespace, "workload", nn.Name)
+
+		if excluded, err := namespaceIsExcluded(context.Background(), l.Client, l.Server, nn.Namespace); err != nil || excluded {
+			if err != nil {
+				log.Error(err, "failed to get namespace", "namespaceName", nn)
+			}
+			log.Sugar().Debugw("skip excluded namespace", "namespaceName", nn)
+			monitoring.AccessLogEntriesDropped.WithLabelValues(monitoring.ProtocolTCP, monitoring.ReasonExcludedNamespace).Inc()
+			continue
+		}
+
+		destSvc, err := l.ipServiceCache.FetchTCPDestinationSvc(entry)
+		if err != nil {
+			log.Sugar().Debugw("skip tcp access log without destination service", "namespaceName", nn, "error", err)
+			monitoring.AccessLogEntriesDropped.WithLabelValues(monitoring.ProtocolTCP, monitoring.ReasonNoDestination).Inc()
+			continue
+		}
+		l.dependencyCache.Record(nn, destSvc, 0)
+		l.batcher.AddHost(monitoring.ProtocolTCP, nn, destSvc)
+		monitoring.AccessLogEntriesProcessed.WithLabelValues(monitoring.ProtocolTCP).Inc()
+	}
+}
+
+func dropReason(err error) string {
+	if errors.IsConflict(err) {
+		return monitoring.ReasonConflict
+	}
+	return monitoring.ReasonError
+}
+
 func (l *LogEntry) getNamespacedName(entry *data_accesslog.HTTPAccessLogEntry) (out types.NamespacedName, err error) {
-	sourceIp, err := l.ipServiceCache.FetchSourceIp(entry)
+	return l.getNamespacedNameFromCommon(entry.GetCommonProperties())
+}
+
+func (l *LogEntry) getNamespacedNameFromCommon(common *data_accesslog.AccessLogCommon) (out types.NamespacedName, err error) {
+	sourceIp, err := l.ipServiceCache.FetchSourceIpFromCommon(common)
 	if err != nil {
 		return
 	}
-	sourceSvc, err := l.ipServiceCache.FetchSourceSvc(sourceIp)
-	if err != nil {
+	if _, err = l.ipServiceCache.FetchSourceSvc(sourceIp); err != nil {
 		err = fmt.Errorf("failed to get source service. source ip is %v", sourceIp)
 		return
 	}
-	return types.NamespacedName{Namespace: sourceSvc.Namespace, Name: sourceSvc.Name}, nil
+	sourcePod, err := l.ipServiceCache.FetchSourcePod(sourceIp)
+	if err != nil {
+		return
+	}
+	// the sidecar is shared by every service of the workload
+	return l.sidecarOfPod(context.Background(), *sourcePod)
 }
 
 func (l *LogEntry) destinationService(entry *data_accesslog.HTTPAccessLogEntry) DestinationService {
-	dest := strings.Split(entry.Request.Authority, ":")[0]
+	dest := cache.AuthorityHost(entry.Request.Authority)
 	if dest == "" || net.ParseIP(dest) != nil {
 		return External
 	}
@@ -128,3 +214,20 @@ func (l *LogEntry) destinationService(entry *data_accesslog.HTTPAccessLogEntry)
 	}
 	return External
 }
+
+// destination returns the destination of the entry as it is recorded in the dependency graph:
+// the fqdn of internal services, and the host of external services.
+func (l *LogEntry) destination(entry *HTTPAccessLogEntryWrapper) (string, error) {
+	if entry.DestinationService == Internal {
+		return l.ipServiceCache.FetchDestinationSvc(entry.HTTPAccessLogEntry)
+	}
+	dest := cache.AuthorityHost(entry.Request.Authority)
+	if dest == "" {
+		return "", fmt.Errorf("authority is empty")
+	}
+	return dest, nil
+}
+
+func isOutboundEntry(entry *data_accesslog.HTTPAccessLogEntry) bool {
+	return strings.HasPrefix(entry.GetCommonProperties().GetUpstreamCluster(), "outbound|")
+}
@@ -2,19 +2,23 @@ package controller
 
 import (
 	"context"
-	goerrors "errors"
 	"fmt"
+	"reflect"
 
+	"github.com/hexiaodai/fence/api/v1alpha1"
 	"github.com/hexiaodai/fence/internal/cache"
 	"github.com/hexiaodai/fence/internal/config"
 	"github.com/hexiaodai/fence/internal/istio"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/labels"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 type NamespaceReconciler struct {
@@ -40,9 +44,10 @@ func NewNamespaceReconciler(opts ...NamespaceReconcilerOpts) *NamespaceReconcile
 func (r *NamespaceReconciler) Reconcile(ctx context.Context, request ctrl.Request) (ctrl.Result, error) {
 	log := r.Logger.WithValues("namespace", request.Namespace, "name", request.Name)
 
-	if isSystemNamespace(r.FenceNamespace, r.IstioNamespace, request.Name) {
-		log.Sugar().Debugw("skip system namespace", "namespaceName", request.NamespacedName)
-		return ctrl.Result{}, nil
+	// the namespace may have been left out of the scope of Fence since its Sidecars were created
+	if r.ExcludesNamespace(request.Name) {
+		log.Sugar().Debugw("tear down excluded namespace", "namespaceName", request.NamespacedName)
+		return r.teardown(ctx, request.Name)
 	}
 
 	instance := &corev1.Namespace{}
@@ -55,9 +60,14 @@ func (r *NamespaceReconciler) Reconcile(ctx context.Context, request ctrl.Reques
 		}
 	}
 
+	if !r.SelectsNamespace(instance.Labels) {
+		log.Sugar().Debugw("tear down namespace not selected by the namespace selector", "namespaceName", request.NamespacedName)
+		return r.teardown(ctx, instance.Name)
+	}
+
 	if namespaceIsDisable(instance) {
-		log.Sugar().Debugw("skip disabled namespace", "namespaceName", request.NamespacedName)
-		return ctrl.Result{}, nil
+		log.Sugar().Debugw("tear down disabled namespace", "namespaceName", request.NamespacedName)
+		return r.teardown(ctx, instance.Name)
 	}
 
 	svcList := &corev1.ServiceList{}
@@ -67,45 +77,63 @@ func (r *NamespaceReconciler) Reconcile(ctx context.Context, request ctrl.Reques
 
 	for _, svc := range svcList.Items {
 		nn := types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}
-		pod, err := r.fetchPod(ctx, &svc)
-		if err != nil {
-			if !goerrors.Is(err, errNotFound) && !errors.IsNotFound(err) {
-				log.Error(err, "failed to fetch pod", "namespaceName", nn)
-			}
-			continue
-		}
-		if !fenceIsEnabled(r.NamespaceCache, r.AutoFence, pod) && !isInjectSidecar(pod) {
-			log.Sugar().Debugw("skip namespace without fence enabled or without sidecar injected", "namespaceName", nn)
-			continue
-		}
-
 		if err := r.Resource.RefreshByService(ctx, &svc); err != nil {
 			if errors.IsConflict(err) {
 				log.Sugar().Debugw(err.Error(), "namespaceName", nn)
 				return ctrl.Result{Requeue: true}, nil
 			}
+			log.Error(err, "failed to refresh resources", "namespaceName", nn)
 		}
 	}
 
 	return ctrl.Result{}, nil
 }
 
-func (r *NamespaceReconciler) fetchPod(ctx context.Context, svc *corev1.Service) (*corev1.Pod, error) {
-	list := &corev1.PodList{}
-	if err := r.Client.List(ctx, list, &client.ListOptions{
-		LabelSelector: labels.Set(svc.Spec.Selector).AsSelector(),
-		Limit:         1,
-	}); err != nil {
-		return nil, fmt.Errorf("failed to list pod: %v", err)
-	}
-	if len(list.Items) == 0 {
-		return nil, errNotFound
+// teardown deletes what Fence created in the namespace, and requeues it on conflicts.
+func (r *NamespaceReconciler) teardown(ctx context.Context, namespace string) (ctrl.Result, error) {
+	if err := r.Resource.TeardownNamespace(ctx, namespace); err != nil {
+		if errors.IsConflict(err) {
+			return ctrl.Result{Requeue: true}, nil
+		}
+		return ctrl.Result{}, err
 	}
-	return &list.Items[0], nil
+	return ctrl.Result{}, nil
 }
 
 func (r *NamespaceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	events := make(chan event.GenericEvent)
+	// the namespace is reconciled once the cache knows its new state, which the Services are
+	// refreshed with
+	r.NamespaceCache.OnTransition(func(name string, from, to cache.NamespaceState) {
+		go func() {
+			events <- event.GenericEvent{Object: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}}
+		}()
+	})
+	r.OnReload(func(old, new config.Server) {
+		if old.AutoFence != new.AutoFence ||
+			!reflect.DeepEqual(old.ExcludeNamespaces, new.ExcludeNamespaces) ||
+			!reflect.DeepEqual(old.IncludeNamespaces, new.IncludeNamespaces) ||
+			old.NamespaceSelector != new.NamespaceSelector {
+			go r.reconcileAll(events)
+		}
+	})
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&corev1.Namespace{}).
+		Watches(&v1alpha1.FencePolicy{}, handler.EnqueueRequestsFromMapFunc(namespaceOfFencePolicy)).
+		Watches(&v1alpha1.ClusterFencePolicy{}, handler.EnqueueRequestsFromMapFunc(r.allNamespaces)).
+		WatchesRawSource(&source.Channel{Source: events}, &handler.EnqueueRequestForObject{}).
 		Complete(r)
 }
+
+// reconcileAll re-evaluates every namespace, once the enablement options are reloaded.
+func (r *NamespaceReconciler) reconcileAll(events chan<- event.GenericEvent) {
+	list := &corev1.NamespaceList{}
+	if err := r.Client.List(context.Background(), list); err != nil {
+		r.Logger.Error(err, "failed to list namespace")
+		return
+	}
+	for i := range list.Items {
+		events <- event.GenericEvent{Object: &list.Items[i]}
+	}
+}
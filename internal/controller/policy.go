@@ -0,0 +1,221 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hexiaodai/fence/api/v1alpha1"
+	iconfig "github.com/hexiaodai/fence/internal/config"
+	iistio "github.com/hexiaodai/fence/internal/istio"
+	networkingv1alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// PolicyForPod returns the effective policy of the pod. The default ClusterFencePolicy is
+// overridden by the mode label of the namespace, then by the namespace wide FencePolicies,
+// which are overridden by the FencePolicies selecting the pod.
+func (r *Resource) PolicyForPod(ctx context.Context, pod *corev1.Pod) (*v1alpha1.FencePolicySpec, error) {
+	return r.policyFor(ctx, pod.Namespace, pod.Labels)
+}
+
+func (r *Resource) policyForSelector(ctx context.Context, namespace string, selector map[string]string) (*v1alpha1.FencePolicySpec, error) {
+	podLabels := labels.Set(selector)
+	if len(selector) > 0 {
+		list := &corev1.PodList{}
+		if err := r.Client.List(ctx, list, &client.ListOptions{
+			Namespace:     namespace,
+			LabelSelector: labels.Set(selector).AsSelector(),
+			Limit:         1,
+		}); err != nil {
+			return nil, fmt.Errorf("failed to list pod: %v", err)
+		}
+		if len(list.Items) > 0 {
+			podLabels = list.Items[0].Labels
+		}
+	}
+	return r.policyFor(ctx, namespace, podLabels)
+}
+
+func (r *Resource) policyFor(ctx context.Context, namespace string, podLabels labels.Set) (*v1alpha1.FencePolicySpec, error) {
+	policy := &v1alpha1.FencePolicySpec{}
+
+	clusterPolicy := &v1alpha1.ClusterFencePolicy{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Name: v1alpha1.DefaultClusterFencePolicyName}, clusterPolicy); err != nil {
+		if meta.IsNoMatchError(err) {
+			// the CRDs are not installed
+			return policy, nil
+		}
+		if !errors.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to get cluster fence policy: %w", err)
+		}
+	} else {
+		mergePolicy(policy, &clusterPolicy.Spec)
+	}
+
+	ns := &corev1.Namespace{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Name: namespace}, ns); err != nil {
+		if !errors.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to get namespace: %w", err)
+		}
+	} else if mode, ok := namespaceMode(ns); ok {
+		policy.Mode = mode
+	}
+
+	list := &v1alpha1.FencePolicyList{}
+	if err := r.Client.List(ctx, list, client.InNamespace(namespace)); err != nil {
+		if meta.IsNoMatchError(err) {
+			return policy, nil
+		}
+		return nil, fmt.Errorf("failed to list fence policy: %w", err)
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+
+	for _, item := range list.Items {
+		if item.Spec.WorkloadSelector == nil {
+			mergePolicy(policy, &item.Spec)
+		}
+	}
+	for _, item := range list.Items {
+		if item.Spec.WorkloadSelector == nil {
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(item.Spec.WorkloadSelector)
+		if err != nil {
+			r.Logger.Error(err, "skip fence policy with invalid workload selector", "namespaceName", types.NamespacedName{Namespace: item.Namespace, Name: item.Name})
+			continue
+		}
+		if selector.Matches(podLabels) {
+			mergePolicy(policy, &item.Spec)
+		}
+	}
+	return policy, nil
+}
+
+func mergePolicy(dst, src *v1alpha1.FencePolicySpec) {
+	if src.Enabled != nil {
+		dst.Enabled = src.Enabled
+	}
+	dst.EgressHosts = append(dst.EgressHosts, src.EgressHosts...)
+	dst.ExcludedDestinations = append(dst.ExcludedDestinations, src.ExcludedDestinations...)
+	if src.HostTTL != nil {
+		dst.HostTTL = src.HostTTL
+	}
+	if src.Mode != "" {
+		dst.Mode = src.Mode
+	}
+}
+
+func isExcludedDestination(policy *v1alpha1.FencePolicySpec, destSvc string) bool {
+	for _, pattern := range policy.ExcludedDestinations {
+		if ok, _ := path.Match(pattern, destSvc); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceMode returns the mode set by the label of the namespace.
+func namespaceMode(ns *corev1.Namespace) (v1alpha1.FenceMode, bool) {
+	switch ns.Labels[iconfig.FenceModeLabel] {
+	case iconfig.FenceModeValueLearning:
+		return v1alpha1.FenceModeLearning, true
+	case iconfig.FenceModeValueEnforcing:
+		return v1alpha1.FenceModeEnforcing, true
+	}
+	return "", false
+}
+
+func isLearningMode(policy *v1alpha1.FencePolicySpec) bool {
+	return policy.Mode == v1alpha1.FenceModeLearning
+}
+
+func policyHostTTL(policy *v1alpha1.FencePolicySpec, defaultTTL time.Duration) time.Duration {
+	if policy.HostTTL != nil {
+		return policy.HostTTL.Duration
+	}
+	return defaultTTL
+}
+
+// applyPolicyToSidecar adds the egress hosts of the policy to the sidecar, removes the ones
+// left over from a previous version of the policy and removes the excluded destinations.
+// It reports whether sidecar was changed.
+func (r *Resource) applyPolicyToSidecar(sidecar *networkingv1alpha3.Sidecar, policy *v1alpha1.FencePolicySpec) bool {
+	current := map[string]struct{}{}
+	for _, host := range policy.EgressHosts {
+		current[host] = struct{}{}
+	}
+	stale := []string{}
+	for _, host := range splitHosts(sidecar.Annotations[iconfig.PolicyEgressHostsAnnotation]) {
+		if _, ok := current[host]; !ok {
+			stale = append(stale, host)
+		}
+	}
+	changed := len(r.sidecar.RemoveHostsFromEgress(sidecar, stale...)) > 0
+	if r.sidecar.AddHostsToEgress(sidecar, policy.EgressHosts...) {
+		changed = true
+	}
+
+	excluded := []string{}
+	for _, host := range iistio.LearnedHosts(sidecar) {
+		if destSvc, _ := iistio.DestinationOfHost(host); isExcludedDestination(policy, destSvc) {
+			excluded = append(excluded, host)
+		}
+	}
+	if len(r.sidecar.RemoveHostsFromEgress(sidecar, excluded...)) > 0 {
+		changed = true
+	}
+
+	annotation := strings.Join(policy.EgressHosts, ",")
+	if sidecar.Annotations[iconfig.PolicyEgressHostsAnnotation] != annotation {
+		if annotation == "" {
+			delete(sidecar.Annotations, iconfig.PolicyEgressHostsAnnotation)
+		} else {
+			if sidecar.Annotations == nil {
+				sidecar.Annotations = map[string]string{}
+			}
+			sidecar.Annotations[iconfig.PolicyEgressHostsAnnotation] = annotation
+		}
+		changed = true
+	}
+	return changed
+}
+
+func splitHosts(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// namespaceOfFencePolicy maps a FencePolicy to its namespace.
+func namespaceOfFencePolicy(ctx context.Context, obj client.Object) []reconcile.Request {
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: obj.GetNamespace()}}}
+}
+
+// allNamespaces maps a ClusterFencePolicy to every namespace.
+func (r *NamespaceReconciler) allNamespaces(ctx context.Context, obj client.Object) []reconcile.Request {
+	if obj.GetName() != v1alpha1.DefaultClusterFencePolicyName {
+		return nil
+	}
+	list := &corev1.NamespaceList{}
+	if err := r.Client.List(ctx, list); err != nil {
+		r.Logger.Error(err, "failed to list namespace")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, ns := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: ns.Name}})
+	}
+	return requests
+}
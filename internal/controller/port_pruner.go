@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hexiaodai/fence/internal/config"
+	iistio "github.com/hexiaodai/fence/internal/istio"
+	"github.com/hexiaodai/fence/internal/monitoring"
+	networkingv1alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// PortPruner periodically removes the ports bound to fence-proxy, and the fence-proxy EnvoyFilters
+// of those ports, which no fence enabled Service exposes anymore. The ports are bound
+// again by RefreshByService when they are used again.
+type PortPruner struct {
+	config.Server
+	client.Client
+	resource *Resource
+}
+
+func NewPortPruner(client client.Client, resource *Resource, server config.Server) *PortPruner {
+	server.Logger = server.Logger.WithName("Prune").WithValues("controller", "PortPruner")
+	return &PortPruner{
+		Client:   client,
+		resource: resource,
+		Server:   server,
+	}
+}
+
+func (p *PortPruner) Start(ctx context.Context) error {
+	p.Logger.Info("started", "pruneInterval", p.PruneInterval)
+	wait.UntilWithContext(ctx, p.prune, p.PruneInterval)
+	return nil
+}
+
+func (p *PortPruner) prune(ctx context.Context) {
+	ports, err := p.desiredPorts(ctx)
+	if err != nil {
+		p.Logger.Error(err, "failed to compute the ports of fence enabled services")
+		return
+	}
+	if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		return p.pruneServicePorts(ctx, ports)
+	}); err != nil {
+		p.Logger.Error(err, "failed to prune fence-proxy service ports")
+	}
+	if err := p.pruneEnvoyFilters(ctx, ports); err != nil {
+		p.Logger.Error(err, "failed to prune fence-proxy envoyFilters")
+	}
+}
+
+// desiredPorts returns the TCP ports of the Services with fence enabled workloads.
+func (p *PortPruner) desiredPorts(ctx context.Context) (map[int32]struct{}, error) {
+	list := &corev1.ServiceList{}
+	if err := p.Client.List(ctx, list); err != nil {
+		return nil, fmt.Errorf("failed to list service: %w", err)
+	}
+	ports := map[int32]struct{}{}
+	for i := range list.Items {
+		svc := &list.Items[i]
+		enabled, _, err := p.resource.enabledWorkloadsOfService(ctx, svc)
+		if err != nil {
+			return nil, err
+		}
+		if len(enabled) == 0 {
+			continue
+		}
+		for _, sp := range svc.Spec.Ports {
+			if sp.Protocol == corev1.ProtocolTCP {
+				ports[sp.Port] = struct{}{}
+			}
+		}
+	}
+	return ports, nil
+}
+
+// pruneServicePorts removes the ports bound by BindPortToFence which are not in ports. The
+// other ports of fence-proxy, e.g. its status port, are left alone.
+func (p *PortPruner) pruneServicePorts(ctx context.Context, ports map[int32]struct{}) error {
+	nn := types.NamespacedName{Namespace: p.FenceNamespace, Name: "fence-proxy"}
+	fenceProxySvc := &corev1.Service{}
+	if err := p.Client.Get(ctx, nn, fenceProxySvc); err != nil {
+		return err
+	}
+	newsps := []corev1.ServicePort{}
+	removed := []int32{}
+	for _, sp := range fenceProxySvc.Spec.Ports {
+		if _, ok := ports[sp.Port]; !ok && sp.Name == fmt.Sprintf("http-%v", sp.Port) {
+			removed = append(removed, sp.Port)
+			continue
+		}
+		newsps = append(newsps, sp)
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	fenceProxySvc.Spec.Ports = newsps
+	if err := p.Client.Update(ctx, fenceProxySvc); err != nil {
+		return err
+	}
+	p.Logger.Info("stale ports removed from fence-proxy service", "namespaceName", nn, "ports", removed)
+	return nil
+}
+
+// pruneEnvoyFilters deletes the fence-proxy EnvoyFilters of the ports which are not in ports.
+func (p *PortPruner) pruneEnvoyFilters(ctx context.Context, ports map[int32]struct{}) error {
+	list := &networkingv1alpha3.EnvoyFilterList{}
+	if err := p.Client.List(ctx, list, client.InNamespace(p.IstioNamespace), client.MatchingLabels{config.ManagedByLabel: config.ManagedByValue}); err != nil {
+		return fmt.Errorf("failed to list envoyFilter: %w", err)
+	}
+	for _, envoyFilter := range list.Items {
+		port, ok := iistio.PortOfFenceProxyEnvoyFilter(envoyFilter.Name)
+		if !ok {
+			continue
+		}
+		if _, wanted := ports[port]; wanted {
+			continue
+		}
+		if err := p.Client.Delete(ctx, envoyFilter); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		monitoring.EnvoyFilterConfigPatches.DeleteLabelValues(envoyFilter.Namespace, envoyFilter.Name)
+		p.Logger.Info("stale fence-proxy envoyFilter removed", "namespaceName", types.NamespacedName{Namespace: envoyFilter.Namespace, Name: envoyFilter.Name}, "port", port)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/hexiaodai/fence/internal/cache"
+	"github.com/hexiaodai/fence/internal/config"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// ProposalWriter periodically updates the Sidecars proposed for the workloads in learning
+// mode with the dependencies learned in the meantime.
+type ProposalWriter struct {
+	config.Server
+	resource        *Resource
+	dependencyCache *cache.Dependency
+	generation      uint64
+}
+
+func NewProposalWriter(resource *Resource, dependencyCache *cache.Dependency, server config.Server) *ProposalWriter {
+	server.Logger = server.Logger.WithName("Propose").WithValues("controller", "ProposalWriter")
+	return &ProposalWriter{
+		resource:        resource,
+		dependencyCache: dependencyCache,
+		Server:          server,
+	}
+}
+
+func (p *ProposalWriter) Start(ctx context.Context) error {
+	p.Logger.Info("started", "proposalInterval", p.ProposalInterval)
+	wait.UntilWithContext(ctx, p.write, p.ProposalInterval)
+	return nil
+}
+
+func (p *ProposalWriter) write(ctx context.Context) {
+	generation := p.dependencyCache.Generation()
+	if generation == p.generation {
+		return
+	}
+	p.resource.WriteProposals(ctx)
+	p.generation = generation
+}
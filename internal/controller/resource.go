@@ -5,50 +5,101 @@ import (
 	goerrors "errors"
 	"fmt"
 	"reflect"
+	"sync"
 
+	"github.com/hexiaodai/fence/api/v1alpha1"
 	"github.com/hexiaodai/fence/internal/cache"
 	"github.com/hexiaodai/fence/internal/config"
 	iistio "github.com/hexiaodai/fence/internal/istio"
+	"github.com/hexiaodai/fence/internal/monitoring"
+	"google.golang.org/protobuf/proto"
+	istio "istio.io/api/networking/v1alpha3"
 	networkingv1alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
-	ctrl "sigs.k8s.io/controller-runtime"
+	"k8s.io/client-go/util/retry"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
 type Resource struct {
 	config.Server
 	client.Client
-	scheme         *runtime.Scheme
-	sidecar        *iistio.Sidecar
-	namespaceCache *cache.Namespace
+	scheme          *runtime.Scheme
+	sidecar         *iistio.Sidecar
+	namespaceCache  *cache.Namespace
+	dependencyCache *cache.Dependency
+	// map[types.NamespacedName]learningWorkload
+	learning sync.Map
+	// map[types.NamespacedName]string, the last written proposals
+	proposals sync.Map
 }
 
-func NewResource(client client.Client, sidecar *iistio.Sidecar, namespaceCache *cache.Namespace, server config.Server, scheme *runtime.Scheme) *Resource {
+func NewResource(client client.Client, sidecar *iistio.Sidecar, namespaceCache *cache.Namespace, dependencyCache *cache.Dependency, server config.Server, scheme *runtime.Scheme) *Resource {
 	server.Logger = server.Logger.WithName("Refresh").WithValues("controller", "Resource")
 	return &Resource{
-		Client:         client,
-		sidecar:        sidecar,
-		namespaceCache: namespaceCache,
-		Server:         server,
-		scheme:         scheme,
+		Client:          client,
+		sidecar:         sidecar,
+		namespaceCache:  namespaceCache,
+		dependencyCache: dependencyCache,
+		Server:          server,
+		scheme:          scheme,
 	}
 }
 
+// RefreshByService binds the ports of the Service to fence, and creates or updates the Sidecars
+// of the fence enabled workloads behind it. The Sidecars of the opted out workloads are deleted.
 func (r *Resource) RefreshByService(ctx context.Context, obj *corev1.Service) error {
 	nn := types.NamespacedName{Namespace: obj.Namespace, Name: obj.Name}.String()
 	r.Logger.Sugar().Debugw("refreshing resources through Service", "function", "RefreshByService", "namespaceName", nn)
+
+	enabled, policies, err := r.enabledWorkloadsOfService(ctx, obj)
+	if err != nil {
+		return err
+	}
+	if err := r.teardownOptedOutWorkloads(ctx, obj, enabled); err != nil {
+		if errors.IsConflict(err) {
+			return err
+		}
+		return fmt.Errorf("failed to tear down opted out workloads. namespaceName %v. %w", nn, err)
+	}
+	if len(enabled) == 0 {
+		r.Logger.Sugar().Debugw("skip service without fence enabled workloads", "function", "RefreshByService", "namespaceName", nn)
+		return nil
+	}
+
 	if err := r.BindPortToFence(ctx, obj.Spec.Ports); err != nil {
 		if errors.IsConflict(err) {
 			return err
 		}
 		return fmt.Errorf("failed to bind port. namespaceName %v. %w", nn, err)
 	}
-	if err := r.CreateSidecar(ctx, obj); err != nil {
-		return fmt.Errorf("failed to create sidecar. namespaceName %v. %w", nn, err)
+	legacy, err := r.legacySidecarOfService(ctx, obj)
+	if err != nil {
+		return fmt.Errorf("failed to get sidecar. namespaceName %v. %w", nn, err)
+	}
+	takenOver := true
+	for i, w := range enabled {
+		if err := r.CreateSidecar(ctx, w, policies[i], legacy); err != nil {
+			if errors.IsConflict(err) {
+				return err
+			}
+			return fmt.Errorf("failed to create sidecar. namespaceName %v. %w", w.NamespacedName, err)
+		}
+		if isLearningMode(policies[i]) {
+			// no workload sidecar took over the egress hosts
+			takenOver = false
+		}
+	}
+	if !takenOver {
+		legacy = nil
+	}
+	if err := r.deleteLegacySidecar(ctx, legacy, enabled); err != nil {
+		return fmt.Errorf("failed to delete sidecar. namespaceName %v. %w", nn, err)
 	}
 	if err := r.AddServiceToEnvoyFilter(ctx, obj); err != nil {
 		if errors.IsConflict(err) {
@@ -60,29 +111,48 @@ func (r *Resource) RefreshByService(ctx context.Context, obj *corev1.Service) er
 	return nil
 }
 
-func (r *Resource) RefreshByHTTPAccessLogEntryWrapper(ctx context.Context, obj *HTTPAccessLogEntryWrapper) error {
-	nn := obj.NamespacedName.String()
-	r.Logger.Sugar().Debugw("refreshing resources through HTTPAccessLog", "function", "RefreshByHTTPAccessLogEntryWrapper", "namespaceName", nn)
-	if obj.DestinationService == Internal {
-		if err := r.AddDestinationServiceToSidecar(obj); err != nil {
-			return fmt.Errorf("failed to add destination service to sidecar. namespaceName: %v. %w", nn, err)
+// enabledWorkloadsOfService returns the fence enabled workloads behind svc, with their policies.
+func (r *Resource) enabledWorkloadsOfService(ctx context.Context, svc *corev1.Service) ([]workload, []*v1alpha1.FencePolicySpec, error) {
+	workloads, err := r.workloadsOfService(ctx, svc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch workloads. namespaceName %v/%v. %w", svc.Namespace, svc.Name, err)
+	}
+	enabled := []workload{}
+	policies := []*v1alpha1.FencePolicySpec{}
+	for _, w := range workloads {
+		policy, err := r.PolicyForPod(ctx, w.pod)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch fence policy. namespaceName %v. %w", w.NamespacedName, err)
 		}
-	} else if obj.DestinationService == External {
-		if err := r.AddExternalServiceToEnvoyFilter(obj); err != nil {
-			return fmt.Errorf("failed to add external service to envoyFilter. namespaceName: %v. %w", nn, err)
+		if !fenceIsEnabled(r.namespaceCache, r.Current().AutoFence, w.pod, policy) || !isInjectSidecar(w.pod) {
+			r.Logger.Sugar().Debugw("skip workload without fence enabled or without sidecar injected", "function", "enabledWorkloadsOfService", "namespaceName", w.NamespacedName)
+			continue
 		}
-	} else {
-		r.Logger.Sugar().Warnw("unknown DestinationService", "function", "RefreshByHTTPAccessLogEntryWrapper", "namespaceName", nn)
+		enabled = append(enabled, w)
+		policies = append(policies, policy)
 	}
-	r.Logger.Sugar().Debugw("refreshing resources successfully", "function", "RefreshByHTTPAccessLogEntryWrapper", "namespaceName", nn)
-	return nil
+	return enabled, policies, nil
 }
 
-func (r *Resource) CreateSidecar(ctx context.Context, svc *corev1.Service) error {
-	nn := types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}
+// CreateSidecar creates the Sidecar of the workload, owned by every Service in front of it.
+// The egress hosts learned by the legacy Sidecar of a Service are carried over.
+func (r *Resource) CreateSidecar(ctx context.Context, w workload, policy *v1alpha1.FencePolicySpec, legacy *networkingv1alpha3.Sidecar) error {
+	nn := w.NamespacedName
 	log := r.Logger.WithName(nn.String()).WithValues("function", "CreateSidecar")
 
-	sidecar, err := r.sidecar.Generate(svc)
+	if isLearningMode(policy) {
+		log.Sugar().Debugw("skip create sidecar in learning mode", "namespaceName", nn)
+		// the workload may have been enforced, and would keep its restricted egress while learning
+		if err := r.deleteFenceSidecar(ctx, nn); err != nil {
+			return err
+		}
+		return r.learnWorkload(ctx, w, policy)
+	}
+	if err := r.promoteWorkload(ctx, nn); err != nil {
+		return err
+	}
+
+	sidecar, err := r.sidecar.Generate(nn, w.selector)
 	if err != nil {
 		if goerrors.Is(err, iistio.ErrNoLabelSelector) {
 			log.Sugar().Warnw("skip create sidecar", "namespaceName", nn, "error", err)
@@ -90,75 +160,247 @@ func (r *Resource) CreateSidecar(ctx context.Context, svc *corev1.Service) error
 		}
 		return err
 	}
-	if err := ctrl.SetControllerReference(svc, sidecar, r.scheme); err != nil {
+	services, err := r.servicesOfWorkload(ctx, w)
+	if err != nil {
+		return err
+	}
+	if err := r.setServiceOwners(sidecar, services); err != nil {
 		return err
 	}
-	if err := r.Client.Create(context.Background(), sidecar); err != nil {
+	r.addLegacyHosts(sidecar, legacy)
+	// the destinations learned so far, e.g. in learning mode
+	r.sidecar.AddHostsToEgress(sidecar, r.learnedHosts(nn, policy)...)
+	r.applyPolicyToSidecar(sidecar, policy)
+	if err := r.Client.Create(ctx, sidecar); err != nil {
 		if errors.IsAlreadyExists(err) {
-			log.Sugar().Warnw("skip create sidecar", "namespaceName", nn, "error", err)
-			return nil
+			return r.updateSidecar(ctx, w, services, policy, legacy)
 		}
 		return err
 	}
+	monitoring.SidecarWrites.WithLabelValues(monitoring.OperationCreate).Inc()
 	log.Sugar().Debugw("create sidecar successfully", "function", "CreateSidecar", "namespaceName", nn)
 	return nil
 }
 
-func (r *Resource) AddDestinationServiceToSidecar(entry *HTTPAccessLogEntryWrapper) error {
-	log := r.Logger.WithName(entry.NamespacedName.String()).WithValues("function", "AddDestinationServiceToSidecar")
+// updateSidecar brings the existing Sidecar of the workload up to date with its selector,
+// its Services and the policy.
+func (r *Resource) updateSidecar(ctx context.Context, w workload, services []corev1.Service, policy *v1alpha1.FencePolicySpec, legacy *networkingv1alpha3.Sidecar) error {
+	nn := w.NamespacedName
+	log := r.Logger.WithName(nn.String()).WithValues("function", "updateSidecar")
 
 	found := &networkingv1alpha3.Sidecar{}
-	if err := r.Client.Get(context.Background(), entry.NamespacedName, found); err != nil {
+	if err := r.Client.Get(ctx, nn, found); err != nil {
+		return err
+	}
+	if !isFenceManagedSidecar(found) {
+		log.Sugar().Warnw("skip update sidecar not managed by fence", "namespaceName", nn)
+		return nil
+	}
+	original := found.DeepCopy()
+
+	if found.Labels == nil {
+		found.Labels = map[string]string{}
+	}
+	found.Labels[config.ManagedByLabel] = config.ManagedByValue
+	if found.Spec.WorkloadSelector == nil {
+		found.Spec.WorkloadSelector = &istio.WorkloadSelector{}
+	}
+	found.Spec.WorkloadSelector.Labels = w.selector
+	if err := r.setServiceOwners(found, services); err != nil {
+		return err
+	}
+	if legacy == nil || legacy.Name != found.Name {
+		r.addLegacyHosts(found, legacy)
+	}
+	r.applyPolicyToSidecar(found, policy)
+
+	if reflect.DeepEqual(original.Labels, found.Labels) &&
+		reflect.DeepEqual(original.OwnerReferences, found.OwnerReferences) &&
+		reflect.DeepEqual(original.Annotations, found.Annotations) &&
+		proto.Equal(&original.Spec, &found.Spec) {
+		log.Sugar().Debugw("skip update sidecar. sidecar is up to date", "namespaceName", nn)
+		return nil
+	}
+	if err := r.Client.Update(ctx, found); err != nil {
+		return err
+	}
+	monitoring.SidecarWrites.WithLabelValues(monitoring.OperationUpdate).Inc()
+	log.Sugar().Debugw("sidecar updated successfully", "function", "updateSidecar", "namespaceName", nn)
+	return nil
+}
+
+// setServiceOwners makes the Services the owners of obj, so that it is garbage collected
+// along with the last of them.
+func (r *Resource) setServiceOwners(obj client.Object, services []corev1.Service) error {
+	obj.SetOwnerReferences(nil)
+	for i := range services {
+		if err := controllerutil.SetOwnerReference(&services[i], obj, r.scheme); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacySidecarOfService returns the Sidecar which older versions of fence generated per Service,
+// named after and controlled by the Service.
+func (r *Resource) legacySidecarOfService(ctx context.Context, svc *corev1.Service) (*networkingv1alpha3.Sidecar, error) {
+	found := &networkingv1alpha3.Sidecar{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}, found); err != nil {
 		if errors.IsNotFound(err) {
-			log.Sugar().Warnw("skip add destination to sidecar", "namespaceName", entry.NamespacedName, "error", err)
+			return nil, nil
+		}
+		return nil, err
+	}
+	owner := metav1.GetControllerOf(found)
+	if owner == nil || owner.Kind != "Service" || owner.UID != svc.UID {
+		return nil, nil
+	}
+	return found, nil
+}
+
+func (r *Resource) addLegacyHosts(sidecar *networkingv1alpha3.Sidecar, legacy *networkingv1alpha3.Sidecar) {
+	if legacy == nil {
+		return
+	}
+	hosts := iistio.LearnedHosts(legacy)
+	r.sidecar.AddHostsToEgress(sidecar, hosts...)
+
+	nn := types.NamespacedName{Namespace: sidecar.Namespace, Name: sidecar.Name}
+	for _, host := range hosts {
+		destSvc, _ := iistio.DestinationOfHost(host)
+		r.dependencyCache.TouchIfAbsent(nn, destSvc)
+	}
+}
+
+// deleteLegacySidecar deletes the legacy Sidecar of a Service once its egress hosts were carried
+// over to the Sidecars of the workloads, unless it was taken over by a workload of the same name.
+func (r *Resource) deleteLegacySidecar(ctx context.Context, legacy *networkingv1alpha3.Sidecar, workloads []workload) error {
+	if legacy == nil {
+		return nil
+	}
+	nn := types.NamespacedName{Namespace: legacy.Namespace, Name: legacy.Name}
+	for _, w := range workloads {
+		if w.NamespacedName == nn {
+			return nil
+		}
+	}
+	if err := r.Client.Delete(ctx, legacy); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	r.dependencyCache.ForgetSource(nn)
+	r.Logger.Sugar().Infow("legacy sidecar of service replaced by workload sidecars", "function", "deleteLegacySidecar", "namespaceName", nn)
+	return nil
+}
+
+// AddDestinationHostsToSidecar adds the egress hosts of destSvcs to the Sidecar nn, in a single
+// update. The Sidecar is not updated if it has them already.
+func (r *Resource) AddDestinationHostsToSidecar(ctx context.Context, nn types.NamespacedName, destSvcs ...string) error {
+	log := r.Logger.WithName(nn.String()).WithValues("function", "AddDestinationHostsToSidecar")
+
+	found := &networkingv1alpha3.Sidecar{}
+	if err := r.Client.Get(ctx, nn, found); err != nil {
+		if errors.IsNotFound(err) {
+			log.Sugar().Warnw("skip add destination to sidecar", "namespaceName", nn, "error", err)
 			return nil
 		}
-		return fmt.Errorf("failed to get sidecar. namespaceName %v. %w", entry.NamespacedName, err)
+		return fmt.Errorf("failed to get sidecar. namespaceName %v. %w", nn, err)
 	}
 
-	if err := r.sidecar.AddDestinationSvcToEgress(found, entry.HTTPAccessLogEntry); err != nil {
-		return fmt.Errorf("failed to add destination service to egress. namespaceName %v. %w", entry.NamespacedName, err)
+	policy, err := r.policyForSelector(ctx, found.Namespace, found.Spec.GetWorkloadSelector().GetLabels())
+	if err != nil {
+		return err
+	}
+	hosts := []string{}
+	for _, destSvc := range destSvcs {
+		if isExcludedDestination(policy, destSvc) {
+			log.Sugar().Debugw("skip add excluded destination to sidecar", "namespaceName", nn, "destination", destSvc)
+			continue
+		}
+		hosts = append(hosts, iistio.EgressHost(destSvc))
+	}
+	if len(hosts) == 0 || !r.sidecar.AddHostsToEgress(found, hosts...) {
+		log.Sugar().Debugw("skip update sidecar. destinations already added", "namespaceName", nn, "destinations", destSvcs)
+		return nil
 	}
-	if err := r.Client.Update(context.Background(), found); err != nil {
+	if err := r.Client.Update(ctx, found); err != nil {
 		return err
 	}
-	log.Sugar().Debugw("destination added successfully to sidecar", "function", "AddDestinationServiceToSidecar", "namespaceName", entry.NamespacedName)
+	monitoring.SidecarWrites.WithLabelValues(monitoring.OperationUpdate).Inc()
+	log.Sugar().Debugw("destinations added successfully to sidecar", "function", "AddDestinationHostsToSidecar", "namespaceName", nn, "destinations", destSvcs)
 	return nil
 }
 
+// AddServiceToEnvoyFilter routes the requests to the ports of svc through fence-proxy, with one
+// EnvoyFilter per port.
 func (r *Resource) AddServiceToEnvoyFilter(ctx context.Context, svc *corev1.Service) error {
 	nn := types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}
 	log := r.Logger.WithName(nn.String()).WithValues("function", "AddServiceToEnvoyFilter")
 
-	envoyFilter := &networkingv1alpha3.EnvoyFilter{}
-	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: r.IstioNamespace, Name: "fence-proxy"}, envoyFilter); err != nil {
-		return err
+	for _, port := range svc.Spec.Ports {
+		if port.Protocol != corev1.ProtocolTCP {
+			continue
+		}
+		if err := r.addPortToEnvoyFilter(ctx, port); err != nil {
+			return err
+		}
+	}
+	log.Sugar().Debugw("service added successfully to envoyFilter", "function", "AddServiceToEnvoyFilter", "namespaceName", nn)
+	return nil
+}
+
+func (r *Resource) addPortToEnvoyFilter(ctx context.Context, port corev1.ServicePort) error {
+	envoyFilter := iistio.GenerateFenceProxyEnvoyFilter(r.IstioNamespace, port.Port)
+	found := &networkingv1alpha3.EnvoyFilter{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: envoyFilter.Namespace, Name: envoyFilter.Name}, found); err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		iistio.MergeFenceProxyEnvoyFilter(&envoyFilter.Spec, port, r.FenceNamespace)
+		if err := r.Client.Create(ctx, envoyFilter); err != nil {
+			return err
+		}
+		monitoring.EnvoyFilterConfigPatches.WithLabelValues(envoyFilter.Namespace, envoyFilter.Name).Set(float64(len(envoyFilter.Spec.ConfigPatches)))
+		return nil
+	}
+	spec := proto.Clone(&found.Spec)
+	iistio.MergeFenceProxyEnvoyFilter(&found.Spec, port, r.FenceNamespace)
+	if proto.Equal(spec, &found.Spec) {
+		return nil
 	}
-	iistio.MergeFenceProxyEnvoyFilter(&envoyFilter.Spec, svc)
-	if err := r.Client.Update(ctx, envoyFilter); err != nil {
+	if err := r.Client.Update(ctx, found); err != nil {
 		return err
 	}
-	log.Sugar().Debugw("service added successfully to envoyFilter", "function", "AddServiceToEnvoyFilter", "namespaceName", nn)
+	monitoring.EnvoyFilterConfigPatches.WithLabelValues(found.Namespace, found.Name).Set(float64(len(found.Spec.ConfigPatches)))
 	return nil
 }
 
-func (r *Resource) AddExternalServiceToEnvoyFilter(entry *HTTPAccessLogEntryWrapper) error {
-	nn := types.NamespacedName{Namespace: r.IstioNamespace, Name: "fence-proxy"}
-	log := r.Logger.WithName(nn.String()).WithValues("function", "AddExternalServiceToEnvoyFilter")
+// AddExternalHostsToEnvoyFilter routes the external authorities of port through fence-proxy, in a
+// single update of the EnvoyFilter of port.
+func (r *Resource) AddExternalHostsToEnvoyFilter(ctx context.Context, port int32, authorities ...string) error {
+	nn := types.NamespacedName{Namespace: r.IstioNamespace, Name: iistio.FenceProxyEnvoyFilterName(port)}
+	log := r.Logger.WithName(nn.String()).WithValues("function", "AddExternalHostsToEnvoyFilter")
 
 	found := &networkingv1alpha3.EnvoyFilter{}
-	if err := r.Client.Get(context.Background(), nn, found); err != nil {
+	if err := r.Client.Get(ctx, nn, found); err != nil {
 		if errors.IsNotFound(err) {
 			log.Sugar().Warnw("skip add external service to envoyFilter", "namespaceName", nn, "error", err)
 			return nil
 		}
 		return fmt.Errorf("failed to get envoyFilter. namespaceName %v. %w", nn.String(), err)
 	}
-	iistio.AddExternalServiceToRouteConfigUration(entry.Request.Authority, found)
-	if err := r.Client.Update(context.Background(), found); err != nil {
+	spec := proto.Clone(&found.Spec)
+	for _, authority := range authorities {
+		iistio.AddExternalServiceToRouteConfigUration(authority, found)
+	}
+	if proto.Equal(spec, &found.Spec) {
+		log.Sugar().Debugw("skip update envoyFilter. external services already added", "namespaceName", nn, "authorities", authorities)
+		return nil
+	}
+	if err := r.Client.Update(ctx, found); err != nil {
 		return err
 	}
-	log.Sugar().Debugw("external service added successfully to envoyFilter", "function", "AddExternalServiceToEnvoyFilter", "namespaceName", nn)
+	monitoring.EnvoyFilterConfigPatches.WithLabelValues(found.Namespace, found.Name).Set(float64(len(found.Spec.ConfigPatches)))
+	log.Sugar().Debugw("external services added successfully to envoyFilter", "function", "AddExternalHostsToEnvoyFilter", "namespaceName", nn, "authorities", authorities)
 	return nil
 }
 
@@ -173,6 +415,10 @@ func (r *Resource) BindPortToFence(ctx context.Context, sps []corev1.ServicePort
 	newsps := []corev1.ServicePort{}
 	indexer := map[int32]struct{}{}
 	for _, p := range fenceProxySvc.Spec.Ports {
+		// the ports bound before fence-proxy listened on each of them target the wormhole port
+		if p.Name == fmt.Sprintf("http-%v", p.Port) {
+			p.TargetPort = r.wormholeTargetPort(p.Port)
+		}
 		newsps = append(newsps, p)
 		indexer[p.Port] = struct{}{}
 	}
@@ -187,7 +433,7 @@ func (r *Resource) BindPortToFence(ctx context.Context, sps []corev1.ServicePort
 			Name:       fmt.Sprintf("http-%v", p.Port),
 			Protocol:   corev1.ProtocolTCP,
 			Port:       p.Port,
-			TargetPort: intstr.Parse(r.WormholePort),
+			TargetPort: r.wormholeTargetPort(p.Port),
 		}
 		newsps = append(newsps, sp)
 	}
@@ -203,3 +449,66 @@ func (r *Resource) BindPortToFence(ctx context.Context, sps []corev1.ServicePort
 	log.Sugar().Debugw("ports bind successfully to fence", "function", "BindPortToFence", "namespaceName", nn)
 	return nil
 }
+
+// wormholeTargetPort returns the port fence-proxy listens on for the requests to port. It is
+// port itself, unless it is taken by fence-proxy.
+func (r *Resource) wormholeTargetPort(port int32) intstr.IntOrString {
+	if p := fmt.Sprint(port); p == r.ProbePort || p == r.MetricsPort {
+		return intstr.Parse(r.WormholePort)
+	}
+	return intstr.FromInt(int(port))
+}
+
+// SeedDependencies indexes the learned egress hosts of the existing Sidecars, so that
+// they can be found by destination before they show up in the access log stream again.
+func (r *Resource) SeedDependencies(ctx context.Context) error {
+	list := &networkingv1alpha3.SidecarList{}
+	if err := r.Client.List(ctx, list); err != nil {
+		return fmt.Errorf("failed to list sidecar. %w", err)
+	}
+	for _, sidecar := range list.Items {
+		if !isFenceManagedSidecar(sidecar) {
+			continue
+		}
+		nn := types.NamespacedName{Namespace: sidecar.Namespace, Name: sidecar.Name}
+		for _, host := range iistio.LearnedHosts(sidecar) {
+			destSvc, _ := iistio.DestinationOfHost(host)
+			r.dependencyCache.TouchIfAbsent(nn, destSvc)
+		}
+	}
+	r.Logger.Sugar().Debugw("dependencies seeded from sidecars", "function", "SeedDependencies", "sidecars", len(list.Items))
+	return nil
+}
+
+// RemoveDestinationServiceFromSidecars removes the deleted service from the egress hosts of
+// every Sidecar which depends on it.
+func (r *Resource) RemoveDestinationServiceFromSidecars(ctx context.Context, svc types.NamespacedName) error {
+	log := r.Logger.WithName(svc.String()).WithValues("function", "RemoveDestinationServiceFromSidecars")
+
+	destSvc := cache.ServiceFQDN(svc)
+	host := iistio.EgressHost(destSvc)
+	for _, nn := range r.dependencyCache.Dependents(destSvc) {
+		retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			found := &networkingv1alpha3.Sidecar{}
+			if err := r.Client.Get(ctx, nn, found); err != nil {
+				return err
+			}
+			if removed := r.sidecar.RemoveHostsFromEgress(found, host); len(removed) == 0 {
+				return nil
+			}
+			if err := r.Client.Update(ctx, found); err != nil {
+				return err
+			}
+			monitoring.SidecarWrites.WithLabelValues(monitoring.OperationUpdate).Inc()
+			return nil
+		})
+		if retryErr != nil && !errors.IsNotFound(retryErr) {
+			return fmt.Errorf("failed to remove destination service from sidecar. namespaceName %v. %w", nn, retryErr)
+		}
+		r.dependencyCache.Forget(nn, destSvc)
+		log.Sugar().Infow("deleted destination service removed from sidecar", "namespaceName", nn, "host", host)
+	}
+	// the legacy sidecar of the deleted service is garbage collected along with it.
+	r.dependencyCache.ForgetSource(svc)
+	return nil
+}
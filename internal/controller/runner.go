@@ -3,10 +3,13 @@ package controller
 import (
 	"context"
 
+	"github.com/hexiaodai/fence/api/v1alpha1"
 	icache "github.com/hexiaodai/fence/internal/cache"
 	"github.com/hexiaodai/fence/internal/config"
+	"github.com/hexiaodai/fence/internal/graph"
 	"github.com/hexiaodai/fence/internal/istio"
 	"github.com/hexiaodai/fence/internal/metric"
+	"github.com/hexiaodai/fence/internal/store"
 	networkingv1alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -14,6 +17,7 @@ import (
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
 
 func New(server config.Server) *Runner {
@@ -38,9 +42,12 @@ func (r *Runner) Start(ctx context.Context) error {
 	scheme := runtime.NewScheme()
 	uruntime.Must(corev1.AddToScheme(scheme))
 	uruntime.Must(networkingv1alpha3.AddToScheme(scheme))
+	uruntime.Must(v1alpha1.AddToScheme(scheme))
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:                  scheme,
+		Scheme: scheme,
+		// the metrics are served by the monitoring runner on MetricsPort
+		MetricsBindAddress:      "0",
 		Port:                    9443,
 		LeaderElectionID:        "fence-controller",
 		LeaderElection:          true,
@@ -76,9 +83,14 @@ func (r *Runner) registerControllers(mgr ctrl.Manager) error {
 		return err
 	}
 
+	dependencyCache := icache.NewDependency(r.Server)
+	if err := r.restoreDependencies(mgr, dependencyCache); err != nil {
+		return err
+	}
+
 	sidecar := istio.NewSidecar(ipService, r.Server)
 
-	resource := NewResource(mgr.GetClient(), sidecar, namespaceCache, r.Server, mgr.GetScheme())
+	resource := NewResource(mgr.GetClient(), sidecar, namespaceCache, dependencyCache, r.Server, mgr.GetScheme())
 
 	if err := NewEndpointsReconciler(func(sr *EndpointsReconciler) {
 		sr.Client = mgr.GetClient()
@@ -102,12 +114,43 @@ func (r *Runner) registerControllers(mgr ctrl.Manager) error {
 		return err
 	}
 
+	if err := mgr.Add(manager.RunnableFunc(resource.MigrateFenceProxyEnvoyFilter)); err != nil {
+		return err
+	}
+
+	if err := mgr.Add(manager.RunnableFunc(resource.SeedDependencies)); err != nil {
+		return err
+	}
+
+	pruner := NewSidecarPruner(mgr.GetClient(), sidecar, dependencyCache, resource, mgr.GetEventRecorderFor("fence"), r.Server)
+	if err := mgr.Add(pruner); err != nil {
+		return err
+	}
+
+	if err := mgr.Add(NewPortPruner(mgr.GetClient(), resource, r.Server)); err != nil {
+		return err
+	}
+
+	if err := mgr.Add(NewProposalWriter(resource, dependencyCache, r.Server)); err != nil {
+		return err
+	}
+
 	metricrunner := metric.New(r.Server)
 	if err := metricrunner.Start(context.Background()); err != nil {
 		return err
 	}
-	le := NewLogEntry(mgr.GetClient(), mgr.GetScheme(), sidecar, namespaceCache, ipService, resource, r.Server)
+	batcher := NewDestinationBatcher(resource, r.Server)
+	if err := mgr.Add(batcher); err != nil {
+		return err
+	}
+	le := NewLogEntry(mgr.GetClient(), mgr.GetScheme(), sidecar, namespaceCache, ipService, dependencyCache, resource, batcher, r.Server)
 	metricrunner.RegisterHttpLogEntry(le)
+	metricrunner.RegisterTcpLogEntry(le)
+
+	graphRunner := graph.New(dependencyCache, r.Server)
+	if err := graphRunner.Start(); err != nil {
+		return err
+	}
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		return err
@@ -118,3 +161,27 @@ func (r *Runner) registerControllers(mgr ctrl.Manager) error {
 
 	return nil
 }
+
+// restoreDependencies rehydrates the dependency graph from the store before any access log
+// is processed, and saves it back periodically.
+func (r *Runner) restoreDependencies(mgr ctrl.Manager, dependencyCache *icache.Dependency) error {
+	depStore, err := store.New(mgr.GetAPIReader(), mgr.GetClient(), r.Server)
+	if err != nil {
+		return err
+	}
+	if depStore == nil {
+		r.Logger.Info("dependency store is disabled")
+		return nil
+	}
+
+	records, err := depStore.Load(context.Background())
+	if err != nil {
+		// the dependencies are learned again from the access logs
+		r.Logger.Error(err, "failed to load dependencies, starting with an empty dependency graph")
+	} else {
+		dependencyCache.Restore(records)
+		r.Logger.Info("dependencies restored", "store", r.DependencyStore, "dependencies", len(records))
+	}
+
+	return mgr.Add(NewDependencySaver(depStore, dependencyCache, r.Server))
+}
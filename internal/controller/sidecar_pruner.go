@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/hexiaodai/fence/internal/cache"
+	"github.com/hexiaodai/fence/internal/config"
+	iistio "github.com/hexiaodai/fence/internal/istio"
+	"github.com/hexiaodai/fence/internal/monitoring"
+	networkingv1alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// SidecarPruner periodically removes the learned egress hosts which have not been
+// seen in the access log stream for longer than HostTTL, or the HostTTL of the
+// FencePolicy. A pruned host which is still in use goes through the fence proxy
+// again and is learned back.
+type SidecarPruner struct {
+	config.Server
+	client.Client
+	sidecar         *iistio.Sidecar
+	dependencyCache *cache.Dependency
+	resource        *Resource
+	recorder        record.EventRecorder
+}
+
+func NewSidecarPruner(client client.Client, sidecar *iistio.Sidecar, dependencyCache *cache.Dependency, resource *Resource, recorder record.EventRecorder, server config.Server) *SidecarPruner {
+	server.Logger = server.Logger.WithName("Prune").WithValues("controller", "SidecarPruner")
+	return &SidecarPruner{
+		Client:          client,
+		sidecar:         sidecar,
+		dependencyCache: dependencyCache,
+		resource:        resource,
+		recorder:        recorder,
+		Server:          server,
+	}
+}
+
+func (p *SidecarPruner) Start(ctx context.Context) error {
+	p.Logger.Info("started", "hostTTL", p.HostTTL, "pruneInterval", p.PruneInterval)
+	wait.UntilWithContext(ctx, p.prune, p.PruneInterval)
+	return nil
+}
+
+func (p *SidecarPruner) prune(ctx context.Context) {
+	list := &networkingv1alpha3.SidecarList{}
+	if err := p.Client.List(ctx, list); err != nil {
+		p.Logger.Error(err, "failed to list sidecar")
+		return
+	}
+	for _, sidecar := range list.Items {
+		if !isFenceManagedSidecar(sidecar) {
+			continue
+		}
+		if err := p.pruneSidecar(ctx, sidecar); err != nil && !errors.IsNotFound(err) {
+			p.Logger.Error(err, "failed to prune sidecar", "namespaceName", types.NamespacedName{Namespace: sidecar.Namespace, Name: sidecar.Name})
+		}
+	}
+}
+
+func (p *SidecarPruner) pruneSidecar(ctx context.Context, sidecar *networkingv1alpha3.Sidecar) error {
+	nn := types.NamespacedName{Namespace: sidecar.Namespace, Name: sidecar.Name}
+	log := p.Logger.WithValues("namespace", nn.Namespace, "name", nn.Name)
+
+	policy, err := p.resource.policyForSelector(ctx, sidecar.Namespace, sidecar.Spec.GetWorkloadSelector().GetLabels())
+	if err != nil {
+		return err
+	}
+	hostTTL := policyHostTTL(policy, p.HostTTL)
+	if hostTTL <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	expired := []string{}
+	for _, host := range iistio.LearnedHosts(sidecar) {
+		destSvc, _ := iistio.DestinationOfHost(host)
+		lastSeen, ok := p.dependencyCache.LastSeen(nn, destSvc)
+		if !ok {
+			// the history of the host is unknown, e.g. after a restart. start counting from now on.
+			p.dependencyCache.TouchIfAbsent(nn, destSvc)
+			continue
+		}
+		if now.Sub(lastSeen) > hostTTL {
+			expired = append(expired, host)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	removed := p.sidecar.RemoveHostsFromEgress(sidecar, expired...)
+	if err := p.Client.Update(ctx, sidecar); err != nil {
+		return err
+	}
+	monitoring.SidecarWrites.WithLabelValues(monitoring.OperationUpdate).Inc()
+	for _, host := range removed {
+		destSvc, _ := iistio.DestinationOfHost(host)
+		p.dependencyCache.Forget(nn, destSvc)
+		log.Info("expired egress host removed from sidecar", "host", host, "hostTTL", hostTTL)
+		p.recorder.Eventf(sidecar, corev1.EventTypeNormal, "EgressHostExpired", "Removed egress host %v, unused for more than %v", host, hostTTL)
+	}
+	return nil
+}
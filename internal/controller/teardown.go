@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hexiaodai/fence/internal/config"
+	iistio "github.com/hexiaodai/fence/internal/istio"
+	"github.com/hexiaodai/fence/internal/monitoring"
+	networkingv1alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// TeardownNamespace deletes the Sidecars and the learning EnvoyFilters Fence created in the
+// namespace, so that its workloads reach every destination again.
+func (r *Resource) TeardownNamespace(ctx context.Context, namespace string) error {
+	sidecars := &networkingv1alpha3.SidecarList{}
+	if err := r.Client.List(ctx, sidecars, client.InNamespace(namespace)); err != nil {
+		return fmt.Errorf("failed to list sidecar. %w", err)
+	}
+	workloads := map[types.NamespacedName]struct{}{}
+	for _, sidecar := range sidecars.Items {
+		if isFenceManagedSidecar(sidecar) {
+			workloads[types.NamespacedName{Namespace: sidecar.Namespace, Name: sidecar.Name}] = struct{}{}
+		}
+	}
+
+	envoyFilters := &networkingv1alpha3.EnvoyFilterList{}
+	if err := r.Client.List(ctx, envoyFilters, client.InNamespace(namespace), client.MatchingLabels{config.ManagedByLabel: config.ManagedByValue}); err != nil {
+		return fmt.Errorf("failed to list envoy filter. %w", err)
+	}
+	for _, envoyFilter := range envoyFilters.Items {
+		if name, ok := iistio.WorkloadOfLearningEnvoyFilter(envoyFilter.Name); ok {
+			workloads[types.NamespacedName{Namespace: namespace, Name: name}] = struct{}{}
+		}
+	}
+
+	for nn := range workloads {
+		if err := r.teardownWorkload(ctx, nn); err != nil {
+			return fmt.Errorf("failed to tear down workload. namespaceName %v. %w", nn, err)
+		}
+	}
+	return nil
+}
+
+// teardownOptedOutWorkloads tears down the workloads behind svc which are not enabled, e.g. opted
+// out by the sidecar.fence.io=disable label of their pods or by a FencePolicy.
+func (r *Resource) teardownOptedOutWorkloads(ctx context.Context, svc *corev1.Service, enabled []workload) error {
+	workloads, err := r.workloadsOfService(ctx, svc)
+	if err != nil {
+		return err
+	}
+	isEnabled := map[types.NamespacedName]struct{}{}
+	for _, w := range enabled {
+		isEnabled[w.NamespacedName] = struct{}{}
+	}
+	for _, w := range workloads {
+		if _, ok := isEnabled[w.NamespacedName]; ok {
+			continue
+		}
+		if err := r.teardownWorkload(ctx, w.NamespacedName); err != nil {
+			return fmt.Errorf("failed to tear down workload. namespaceName %v. %w", w.NamespacedName, err)
+		}
+	}
+	return nil
+}
+
+// teardownWorkload deletes the Sidecar of the workload, if Fence created it, and stops learning
+// the workload. Its learned dependencies are kept, for the Sidecar to be recreated with them.
+func (r *Resource) teardownWorkload(ctx context.Context, nn types.NamespacedName) error {
+	if err := r.promoteWorkload(ctx, nn); err != nil {
+		return err
+	}
+	return r.deleteFenceSidecar(ctx, nn)
+}
+
+// deleteFenceSidecar deletes the Sidecar nn if Fence created it. Its learned hosts are kept in
+// the dependency cache, for the Sidecar to be recreated with them.
+func (r *Resource) deleteFenceSidecar(ctx context.Context, nn types.NamespacedName) error {
+	found := &networkingv1alpha3.Sidecar{}
+	if err := r.Client.Get(ctx, nn, found); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if !isFenceManagedSidecar(found) {
+		return nil
+	}
+	for _, host := range iistio.LearnedHosts(found) {
+		destSvc, _ := iistio.DestinationOfHost(host)
+		r.dependencyCache.TouchIfAbsent(nn, destSvc)
+	}
+	if err := r.Client.Delete(ctx, found); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	monitoring.SidecarWrites.WithLabelValues(monitoring.OperationDelete).Inc()
+	r.Logger.Sugar().Infow("sidecar deleted", "function", "deleteFenceSidecar", "namespaceName", nn)
+	return nil
+}
@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hexiaodai/fence/internal/cache"
+	"github.com/hexiaodai/fence/internal/config"
+	networkingv1alpha3api "istio.io/api/networking/v1alpha3"
+	networkingv1alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDeleteFenceSidecar(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = networkingv1alpha3.AddToScheme(scheme)
+	managed := &networkingv1alpha3.Sidecar{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deployment-reviews", Labels: map[string]string{config.ManagedByLabel: config.ManagedByValue}},
+		Spec:       networkingv1alpha3api.Sidecar{Egress: []*networkingv1alpha3api.IstioEgressListener{{Hosts: []string{"istio-system/*", "*/ratings.default.svc.cluster.local"}}}},
+	}
+	userOwned := &networkingv1alpha3.Sidecar{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deployment-details"},
+	}
+	server := config.Default()
+	r := &Resource{
+		Server:          server,
+		Client:          fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(managed, userOwned).Build(),
+		dependencyCache: cache.NewDependency(server),
+	}
+
+	ctx := context.Background()
+	reviews := types.NamespacedName{Namespace: "default", Name: "deployment-reviews"}
+	if err := r.deleteFenceSidecar(ctx, reviews); err != nil {
+		t.Fatalf("deleteFenceSidecar() error = %v", err)
+	}
+	if err := r.Client.Get(ctx, reviews, &networkingv1alpha3.Sidecar{}); !errors.IsNotFound(err) {
+		t.Errorf("Get(%v) error = %v, want NotFound", reviews, err)
+	}
+	if got, want := r.dependencyCache.Destinations(reviews), []string{"ratings.default.svc.cluster.local"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Destinations(%v) = %v, want %v", reviews, got, want)
+	}
+
+	details := types.NamespacedName{Namespace: "default", Name: "deployment-details"}
+	if err := r.deleteFenceSidecar(ctx, details); err != nil {
+		t.Fatalf("deleteFenceSidecar() error = %v", err)
+	}
+	if err := r.Client.Get(ctx, details, &networkingv1alpha3.Sidecar{}); err != nil {
+		t.Errorf("Get(%v) error = %v, want the Sidecar kept", details, err)
+	}
+
+	missing := types.NamespacedName{Namespace: "default", Name: "deployment-productpage"}
+	if err := r.deleteFenceSidecar(ctx, missing); err != nil {
+		t.Errorf("deleteFenceSidecar(%v) error = %v, want nil", missing, err)
+	}
+}
@@ -1,16 +1,24 @@
 package controller
 
 import (
+	"context"
+
+	"github.com/hexiaodai/fence/api/v1alpha1"
 	"github.com/hexiaodai/fence/internal/cache"
 	iconfig "github.com/hexiaodai/fence/internal/config"
+	networkingv1alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type VarNamespace interface {
 	*corev1.Namespace | *cache.Namespace
 }
 
-func fenceIsEnabled[T VarNamespace](namespace T, autoFence bool, pod *corev1.Pod) bool {
+func fenceIsEnabled[T VarNamespace](namespace T, autoFence bool, pod *corev1.Pod, policy *v1alpha1.FencePolicySpec) bool {
 	var nsEnabled bool
 	switch any(namespace).(type) {
 	case *corev1.Namespace:
@@ -42,7 +50,14 @@ func fenceIsEnabled[T VarNamespace](namespace T, autoFence bool, pod *corev1.Pod
 	}
 
 	svcEnabled := pod.Labels[iconfig.SidecarFenceLabel] == iconfig.SidecarFenceValueEnabled
-	return autoFence || nsEnabled || svcEnabled
+	if svcEnabled {
+		return true
+	}
+	// policy
+	if policy != nil && policy.Enabled != nil {
+		return *policy.Enabled
+	}
+	return autoFence || nsEnabled
 }
 
 func namespaceIsDisable(ns *corev1.Namespace) bool {
@@ -58,8 +73,31 @@ func isInjectSidecar(pod *corev1.Pod) bool {
 	return false
 }
 
-func isSystemNamespace(namespace, istioNamespace, targetNs string) bool {
-	include := map[string]struct{}{namespace: {}, istioNamespace: {}, "kube-system": {}}
-	_, ok := include[targetNs]
-	return ok
+// namespaceIsExcluded reports whether Fence leaves the namespace alone, because of its name or,
+// when a namespace selector is set, of its labels.
+func namespaceIsExcluded(ctx context.Context, c client.Client, server iconfig.Server, namespace string) (bool, error) {
+	if server.ExcludesNamespace(namespace) {
+		return true, nil
+	}
+	if server.Current().NamespaceSelector == "" {
+		return false, nil
+	}
+	ns := &corev1.Namespace{}
+	if err := c.Get(ctx, types.NamespacedName{Name: namespace}, ns); err != nil {
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return !server.SelectsNamespace(ns.Labels), nil
+}
+
+// isFenceManagedSidecar reports whether the sidecar was created by Fence.
+// Sidecars created by older versions carry no label, but are controlled by their Service.
+func isFenceManagedSidecar(sidecar *networkingv1alpha3.Sidecar) bool {
+	if sidecar.Labels[iconfig.ManagedByLabel] == iconfig.ManagedByValue {
+		return true
+	}
+	owner := metav1.GetControllerOf(sidecar)
+	return owner != nil && owner.Kind == "Service"
 }
@@ -0,0 +1,203 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// perPodLabels are set by the workload controllers on each pod, or on each revision of the
+// pods. They are left out of the workload selector, so that it selects every pod of the workload.
+var perPodLabels = []string{
+	"pod-template-hash",
+	"controller-revision-hash",
+	"pod-template-generation",
+	"statefulset.kubernetes.io/pod-name",
+	"apps.kubernetes.io/pod-index",
+}
+
+// workload is a group of pods which share one Sidecar, whatever the number of Services
+// selecting them.
+type workload struct {
+	// the name of the Sidecar
+	types.NamespacedName
+	// selector is the workload selector of the Sidecar
+	selector map[string]string
+	// pod is one of the pods of the workload
+	pod *corev1.Pod
+}
+
+// workloadOfPod groups pod by its controller, e.g. the Deployment of its ReplicaSet, and selects
+// the pods of the controller with its own selector, so that the labels changed by a rollout do
+// not change the workload. The pods without controller are grouped by their labels.
+func (r *Resource) workloadOfPod(ctx context.Context, pod *corev1.Pod) (workload, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		selector := podSelector(pod)
+		h := fnv.New32a()
+		h.Write([]byte(labels.Set(selector).String()))
+		return workload{
+			NamespacedName: types.NamespacedName{Namespace: pod.Namespace, Name: fmt.Sprintf("fence-%08x", h.Sum32())},
+			selector:       selector,
+			pod:            pod,
+		}, nil
+	}
+
+	kind, name, labelSelector, err := r.controllerOfPod(ctx, pod, owner)
+	if err != nil {
+		return workload{}, err
+	}
+	selector := map[string]string{}
+	if labelSelector != nil {
+		for k, v := range labelSelector.MatchLabels {
+			selector[k] = v
+		}
+	}
+	for _, label := range perPodLabels {
+		delete(selector, label)
+	}
+	if len(selector) == 0 {
+		// e.g. a controller selecting its pods by expressions, which a Sidecar does not support
+		selector = podSelector(pod)
+	}
+
+	return workload{
+		NamespacedName: types.NamespacedName{Namespace: pod.Namespace, Name: strings.ToLower(kind) + "-" + name},
+		selector:       selector,
+		pod:            pod,
+	}, nil
+}
+
+// controllerOfPod returns the kind, the name and the pod selector of the controller of pod, owner:
+// the Deployment of a ReplicaSet, or owner itself. The selector is nil if it is unknown.
+func (r *Resource) controllerOfPod(ctx context.Context, pod *corev1.Pod, owner *metav1.OwnerReference) (string, string, *metav1.LabelSelector, error) {
+	nn := types.NamespacedName{Namespace: pod.Namespace, Name: owner.Name}
+	switch owner.Kind {
+	case "ReplicaSet":
+		rs := &appsv1.ReplicaSet{}
+		if err := r.Client.Get(ctx, nn, rs); err != nil {
+			if !errors.IsNotFound(err) {
+				return "", "", nil, fmt.Errorf("failed to get replicaset: %w", err)
+			}
+			// the ReplicaSet is gone before its pods
+			if hash := pod.Labels["pod-template-hash"]; hash != "" {
+				return "Deployment", strings.TrimSuffix(owner.Name, "-"+hash), nil, nil
+			}
+			return owner.Kind, owner.Name, nil, nil
+		}
+		deploymentOwner := metav1.GetControllerOf(rs)
+		if deploymentOwner == nil || deploymentOwner.Kind != "Deployment" {
+			return owner.Kind, owner.Name, rs.Spec.Selector, nil
+		}
+		deployment := &appsv1.Deployment{}
+		if err := r.Client.Get(ctx, types.NamespacedName{Namespace: pod.Namespace, Name: deploymentOwner.Name}, deployment); err != nil {
+			if !errors.IsNotFound(err) {
+				return "", "", nil, fmt.Errorf("failed to get deployment: %w", err)
+			}
+			return deploymentOwner.Kind, deploymentOwner.Name, rs.Spec.Selector, nil
+		}
+		return deploymentOwner.Kind, deploymentOwner.Name, deployment.Spec.Selector, nil
+	case "StatefulSet":
+		sts := &appsv1.StatefulSet{}
+		if err := r.Client.Get(ctx, nn, sts); err != nil {
+			if !errors.IsNotFound(err) {
+				return "", "", nil, fmt.Errorf("failed to get statefulset: %w", err)
+			}
+			return owner.Kind, owner.Name, nil, nil
+		}
+		return owner.Kind, owner.Name, sts.Spec.Selector, nil
+	case "DaemonSet":
+		ds := &appsv1.DaemonSet{}
+		if err := r.Client.Get(ctx, nn, ds); err != nil {
+			if !errors.IsNotFound(err) {
+				return "", "", nil, fmt.Errorf("failed to get daemonset: %w", err)
+			}
+			return owner.Kind, owner.Name, nil, nil
+		}
+		return owner.Kind, owner.Name, ds.Spec.Selector, nil
+	}
+	return owner.Kind, owner.Name, nil, nil
+}
+
+// podSelector returns the labels of pod, without perPodLabels.
+func podSelector(pod *corev1.Pod) map[string]string {
+	selector := map[string]string{}
+	for k, v := range pod.Labels {
+		selector[k] = v
+	}
+	for _, label := range perPodLabels {
+		delete(selector, label)
+	}
+	return selector
+}
+
+// workloadsOfService returns the workloads of the pods selected by svc, sorted by name.
+func (r *Resource) workloadsOfService(ctx context.Context, svc *corev1.Service) ([]workload, error) {
+	if len(svc.Spec.Selector) == 0 {
+		return nil, nil
+	}
+	list := &corev1.PodList{}
+	if err := r.Client.List(ctx, list, &client.ListOptions{
+		Namespace:     svc.Namespace,
+		LabelSelector: labels.Set(svc.Spec.Selector).AsSelector(),
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list pod: %v", err)
+	}
+	indexer := map[types.NamespacedName]struct{}{}
+	workloads := []workload{}
+	for i := range list.Items {
+		w, err := r.workloadOfPod(ctx, &list.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := indexer[w.NamespacedName]; ok {
+			continue
+		}
+		indexer[w.NamespacedName] = struct{}{}
+		workloads = append(workloads, w)
+	}
+	sort.Slice(workloads, func(i, j int) bool { return workloads[i].Name < workloads[j].Name })
+	return workloads, nil
+}
+
+// servicesOfWorkload returns the Services which select the pods of w, sorted by name.
+func (r *Resource) servicesOfWorkload(ctx context.Context, w workload) ([]corev1.Service, error) {
+	list := &corev1.ServiceList{}
+	if err := r.Client.List(ctx, list, client.InNamespace(w.Namespace)); err != nil {
+		return nil, fmt.Errorf("failed to list service: %v", err)
+	}
+	services := []corev1.Service{}
+	for _, svc := range list.Items {
+		if len(svc.Spec.Selector) == 0 {
+			continue
+		}
+		if labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(w.pod.Labels)) {
+			services = append(services, svc)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services, nil
+}
+
+// sidecarOfPod returns the name of the Sidecar of the pod.
+func (l *LogEntry) sidecarOfPod(ctx context.Context, nn types.NamespacedName) (types.NamespacedName, error) {
+	pod := &corev1.Pod{}
+	if err := l.Client.Get(ctx, nn, pod); err != nil {
+		return types.NamespacedName{}, fmt.Errorf("failed to get pod: %w", err)
+	}
+	w, err := l.resource.workloadOfPod(ctx, pod)
+	if err != nil {
+		return types.NamespacedName{}, err
+	}
+	return w.NamespacedName, nil
+}
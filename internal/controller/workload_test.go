@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func controlledBy(kind, name string) []metav1.OwnerReference {
+	controller := true
+	return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+}
+
+func TestWorkloadOfPod(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "reviews"}}
+	objs := []runtime.Object{
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "reviews"},
+			Spec:       appsv1.DeploymentSpec{Selector: selector},
+		},
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "reviews-5d7f8b9c6", OwnerReferences: controlledBy("Deployment", "reviews")},
+			Spec:       appsv1.ReplicaSetSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "reviews", "pod-template-hash": "5d7f8b9c6"}}},
+		},
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "reviews-7c9d6f5b8", OwnerReferences: controlledBy("Deployment", "reviews")},
+			Spec:       appsv1.ReplicaSetSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "reviews", "pod-template-hash": "7c9d6f5b8"}}},
+		},
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "reviews"},
+			Spec:       appsv1.StatefulSetSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "reviews-db"}}},
+		},
+	}
+	r := &Resource{Client: fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objs...).Build()}
+
+	// the pods of two revisions of a rollout, which changed the template labels
+	oldPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       "default",
+		Name:            "reviews-5d7f8b9c6-abcde",
+		Labels:          map[string]string{"app": "reviews", "version": "v1", "pod-template-hash": "5d7f8b9c6"},
+		OwnerReferences: controlledBy("ReplicaSet", "reviews-5d7f8b9c6"),
+	}}
+	newPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       "default",
+		Name:            "reviews-7c9d6f5b8-fghij",
+		Labels:          map[string]string{"app": "reviews", "version": "v2", "helm.sh/chart": "reviews-1.1.0", "pod-template-hash": "7c9d6f5b8"},
+		OwnerReferences: controlledBy("ReplicaSet", "reviews-7c9d6f5b8"),
+	}}
+	statefulPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       "default",
+		Name:            "reviews-0",
+		Labels:          map[string]string{"app": "reviews-db", "statefulset.kubernetes.io/pod-name": "reviews-0"},
+		OwnerReferences: controlledBy("StatefulSet", "reviews"),
+	}}
+
+	ctx := context.Background()
+	oldWorkload, err := r.workloadOfPod(ctx, oldPod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newWorkload, err := r.workloadOfPod(ctx, newPod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldWorkload.Name != "deployment-reviews" || newWorkload.Name != "deployment-reviews" {
+		t.Errorf("workloads = %v and %v, want deployment-reviews", oldWorkload.Name, newWorkload.Name)
+	}
+	want := map[string]string{"app": "reviews"}
+	if !reflect.DeepEqual(oldWorkload.selector, want) || !reflect.DeepEqual(newWorkload.selector, want) {
+		t.Errorf("selectors = %v and %v, want %v", oldWorkload.selector, newWorkload.selector, want)
+	}
+
+	statefulWorkload, err := r.workloadOfPod(ctx, statefulPod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statefulWorkload.Name != "statefulset-reviews" {
+		t.Errorf("workload = %v, want statefulset-reviews", statefulWorkload.Name)
+	}
+	if want := map[string]string{"app": "reviews-db"}; !reflect.DeepEqual(statefulWorkload.selector, want) {
+		t.Errorf("selector = %v, want %v", statefulWorkload.selector, want)
+	}
+}
+
+func TestWorkloadOfPodWithoutOwner(t *testing.T) {
+	r := &Resource{Client: fake.NewClientBuilder().Build()}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "debug", Labels: map[string]string{"app": "debug"}}}
+
+	w, err := r.workloadOfPod(context.Background(), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"app": "debug"}; !reflect.DeepEqual(w.selector, want) {
+		t.Errorf("selector = %v, want %v", w.selector, want)
+	}
+}
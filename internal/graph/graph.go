@@ -0,0 +1,111 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hexiaodai/fence/internal/cache"
+)
+
+// Graph is the exported dependency graph. Workloads and services are named "namespace/name",
+// external destinations by their host.
+type Graph struct {
+	Nodes []string `json:"nodes"`
+	Edges []Edge   `json:"edges"`
+}
+
+type Edge struct {
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+	Requests    uint64    `json:"requests"`
+	// map[responseCode]requests
+	ResponseCodes map[string]uint64 `json:"responseCodes,omitempty"`
+}
+
+func newGraph(records []cache.DependencyRecord) *Graph {
+	graph := &Graph{Nodes: []string{}, Edges: []Edge{}}
+	nodes := map[string]struct{}{}
+	for _, record := range records {
+		edge := Edge{
+			Source:      record.Source.String(),
+			Destination: nodeName(record.Destination),
+			FirstSeen:   record.FirstSeen,
+			LastSeen:    record.LastSeen,
+			Requests:    record.Requests,
+		}
+		if len(record.ResponseCodes) > 0 {
+			edge.ResponseCodes = map[string]uint64{}
+			for code, requests := range record.ResponseCodes {
+				edge.ResponseCodes[strconv.Itoa(int(code))] = requests
+			}
+		}
+		graph.Edges = append(graph.Edges, edge)
+		nodes[edge.Source] = struct{}{}
+		nodes[edge.Destination] = struct{}{}
+	}
+	for node := range nodes {
+		graph.Nodes = append(graph.Nodes, node)
+	}
+	sort.Strings(graph.Nodes)
+	return graph
+}
+
+// nodeName names the fqdn of a service "namespace/name", like the sources.
+func nodeName(destination string) string {
+	parts := strings.Split(destination, ".")
+	if len(parts) == 5 && strings.HasSuffix(destination, ".svc.cluster.local") {
+		return fmt.Sprintf("%v/%v", parts[1], parts[0])
+	}
+	return destination
+}
+
+func (g *Graph) writeJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(g)
+}
+
+func (g *Graph) writeDOT(w io.Writer) error {
+	b := &strings.Builder{}
+	b.WriteString("digraph fence {\n")
+	b.WriteString("  rankdir=LR;\n")
+	for _, node := range g.Nodes {
+		fmt.Fprintf(b, "  %q;\n", node)
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(b, "  %q -> %q [label=%q];\n", edge.Source, edge.Destination, edgeLabel(edge))
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (g *Graph) writeMermaid(w io.Writer) error {
+	ids := map[string]string{}
+	b := &strings.Builder{}
+	b.WriteString("graph LR\n")
+	for i, node := range g.Nodes {
+		ids[node] = fmt.Sprintf("n%d", i)
+		fmt.Fprintf(b, "  %v[\"%v\"]\n", ids[node], mermaidEscape(node))
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(b, "  %v -->|\"%v\"| %v\n", ids[edge.Source], mermaidEscape(edgeLabel(edge)), ids[edge.Destination])
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func edgeLabel(edge Edge) string {
+	return fmt.Sprintf("%d requests", edge.Requests)
+}
+
+func mermaidEscape(s string) string {
+	return strings.ReplaceAll(s, "\"", "#quot;")
+}
@@ -0,0 +1,71 @@
+package graph
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/hexiaodai/fence/internal/cache"
+	"github.com/hexiaodai/fence/internal/config"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatDOT     = "dot"
+	FormatMermaid = "mermaid"
+)
+
+func New(dependencyCache *cache.Dependency, server config.Server) *Runner {
+	server.Logger = server.Logger.WithName("Runner").WithValues("graph", "Runner")
+	return &Runner{Server: server, dependencyCache: dependencyCache}
+}
+
+// Runner serves the learned dependency graph on GraphPort.
+type Runner struct {
+	dependencyCache *cache.Dependency
+	config.Server
+}
+
+func (r *Runner) Start() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/graph", r.serveGraph)
+
+	addr := fmt.Sprintf(":%v", r.GraphPort)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			r.Logger.Error(err, "failed to start dependency graph listener", "addr", r.GraphPort)
+			return
+		}
+	}()
+
+	r.Logger.Info("started", "addr", r.GraphPort)
+	return nil
+}
+
+// serveGraph writes the dependency graph in the format given by the "format" query parameter.
+func (r *Runner) serveGraph(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	graph := newGraph(r.dependencyCache.Records())
+
+	var err error
+	switch format := req.URL.Query().Get("format"); format {
+	case "", FormatJSON:
+		w.Header().Set("Content-Type", "application/json")
+		err = graph.writeJSON(w)
+	case FormatDOT:
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		err = graph.writeDOT(w)
+	case FormatMermaid:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err = graph.writeMermaid(w)
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q, supported formats are %v, %v and %v", format, FormatJSON, FormatDOT, FormatMermaid), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		r.Logger.Error(err, "failed to write dependency graph")
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/hexiaodai/fence/internal/config"
 	"google.golang.org/protobuf/types/known/structpb"
 	"istio.io/api/networking/v1alpha3"
 	networkingv1alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var (
@@ -19,30 +21,88 @@ var (
 	fenceProxyVhost = &v1alpha3.EnvoyFilter_RouteConfigurationMatch_VirtualHostMatch{Name: "fence_proxy"}
 )
 
-func MergeFenceProxyEnvoyFilter(envoyFilter *v1alpha3.EnvoyFilter, svc *corev1.Service) {
-	for _, port := range svc.Spec.Ports {
-		if port.Protocol != corev1.ProtocolTCP {
-			continue
-		}
-		if !alreadyAllowAnyVirtualHost(envoyFilter, port) {
-			envoyFilter.ConfigPatches = append(envoyFilter.ConfigPatches, generateVirtualHost(port, emptyProxyMatch, allowAnyVhost))
-		}
-		if !alreadyVirtualHost(envoyFilter, port) {
-			envoyFilter.ConfigPatches = append(envoyFilter.ConfigPatches, generateVirtualHost(port, fenceProxyMatch, fenceProxyVhost))
-		}
-		if !alreadyRouteConfigUration(envoyFilter, port) {
-			envoyFilter.ConfigPatches = append(envoyFilter.ConfigPatches, generateRouteConfigUration(port))
-		}
-		if !alreadyAllowAnyNewRouteConfigUration(envoyFilter, port) {
-			envoyFilter.ConfigPatches = append(envoyFilter.ConfigPatches, generateRouteConfigUrationAllowAnyNew(port))
-		}
-		if !alreadyHttpFilter(envoyFilter, port) {
-			envoyFilter.ConfigPatches = append(envoyFilter.ConfigPatches, generateHttpFilter(port))
-		}
-		if !alreadyHttpRoute(envoyFilter, port) {
-			envoyFilter.ConfigPatches = append(envoyFilter.ConfigPatches, generateHttpRoute(port, fenceProxyVhost))
+// FenceProxyEnvoyFilterName returns the name of the EnvoyFilter which routes the requests to
+// port through fence-proxy.
+func FenceProxyEnvoyFilterName(port int32) string {
+	return fmt.Sprintf("fence-proxy-%v", port)
+}
+
+// GenerateFenceProxyEnvoyFilter returns the empty EnvoyFilter of port, in namespace.
+func GenerateFenceProxyEnvoyFilter(namespace string, port int32) *networkingv1alpha3.EnvoyFilter {
+	return &networkingv1alpha3.EnvoyFilter{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      FenceProxyEnvoyFilterName(port),
+			Namespace: namespace,
+			Labels: map[string]string{
+				config.ManagedByLabel: config.ManagedByValue,
+			},
+		},
+	}
+}
+
+// FenceProxyCluster returns the cluster of the fence-proxy Service in fenceNamespace which
+// receives the requests to port.
+func FenceProxyCluster(fenceNamespace string, port int32) string {
+	return fmt.Sprintf("outbound|%v||fence-proxy.%v.svc.cluster.local", port, fenceNamespace)
+}
+
+// MergeFenceProxyEnvoyFilter adds the config patches of svcPort which envoyFilter lacks, and
+// routes the requests to svcPort to the same port of fence-proxy, in fenceNamespace.
+func MergeFenceProxyEnvoyFilter(envoyFilter *v1alpha3.EnvoyFilter, port corev1.ServicePort, fenceNamespace string) {
+	if !alreadyAllowAnyVirtualHost(envoyFilter, port) {
+		envoyFilter.ConfigPatches = append(envoyFilter.ConfigPatches, generateVirtualHost(port, emptyProxyMatch, allowAnyVhost))
+	}
+	if !alreadyVirtualHost(envoyFilter, port) {
+		envoyFilter.ConfigPatches = append(envoyFilter.ConfigPatches, generateVirtualHost(port, fenceProxyMatch, fenceProxyVhost))
+	}
+	if !alreadyRouteConfigUration(envoyFilter, port) {
+		envoyFilter.ConfigPatches = append(envoyFilter.ConfigPatches, generateRouteConfigUration(port, fenceNamespace))
+	}
+	// older versions routed every port to port 80 of fence-proxy
+	setFenceProxyCluster(envoyFilter, port, FenceProxyCluster(fenceNamespace, port.Port))
+	if !alreadyAllowAnyNewRouteConfigUration(envoyFilter, port) {
+		envoyFilter.ConfigPatches = append(envoyFilter.ConfigPatches, generateRouteConfigUrationAllowAnyNew(port))
+	}
+	if !alreadyHttpFilter(envoyFilter, port) {
+		envoyFilter.ConfigPatches = append(envoyFilter.ConfigPatches, generateHttpFilter(port))
+	}
+	if !alreadyHttpRoute(envoyFilter, port) {
+		envoyFilter.ConfigPatches = append(envoyFilter.ConfigPatches, generateHttpRoute(port, fenceProxyVhost))
+	}
+}
+
+// SplitFenceProxyEnvoyFilter groups the config patches of the legacy fence-proxy EnvoyFilter,
+// which holds every port, by port. The patches without a port are left out.
+func SplitFenceProxyEnvoyFilter(envoyFilter *v1alpha3.EnvoyFilter) map[int32][]*v1alpha3.EnvoyFilter_EnvoyConfigObjectPatch {
+	patches := map[int32][]*v1alpha3.EnvoyFilter_EnvoyConfigObjectPatch{}
+	for _, patch := range envoyFilter.ConfigPatches {
+		if port, ok := portOfPatch(patch); ok {
+			patches[port] = append(patches[port], patch)
 		}
 	}
+	return patches
+}
+
+// PortOfFenceProxyEnvoyFilter returns the port of the EnvoyFilter named by FenceProxyEnvoyFilterName.
+func PortOfFenceProxyEnvoyFilter(name string) (int32, bool) {
+	port, err := strconv.ParseInt(strings.TrimPrefix(name, "fence-proxy-"), 10, 32)
+	if err != nil || !strings.HasPrefix(name, "fence-proxy-") {
+		return 0, false
+	}
+	return int32(port), true
+}
+
+// portOfPatch returns the port of the route configuration, or of the listener, matched by patch.
+func portOfPatch(patch *v1alpha3.EnvoyFilter_EnvoyConfigObjectPatch) (int32, bool) {
+	name := patch.GetMatch().GetRouteConfiguration().GetName()
+	if name == "" {
+		name = strings.TrimPrefix(patch.GetMatch().GetListener().GetName(), "0.0.0.0_")
+	}
+	port, err := strconv.ParseInt(name, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return int32(port), true
 }
 
 func generateVirtualHost(svcPort corev1.ServicePort, proxyMatch *v1alpha3.EnvoyFilter_ProxyMatch, vhost *v1alpha3.EnvoyFilter_RouteConfigurationMatch_VirtualHostMatch) *v1alpha3.EnvoyFilter_EnvoyConfigObjectPatch {
@@ -66,7 +126,7 @@ func generateVirtualHost(svcPort corev1.ServicePort, proxyMatch *v1alpha3.EnvoyF
 	return config
 }
 
-func generateRouteConfigUration(svcPort corev1.ServicePort) *v1alpha3.EnvoyFilter_EnvoyConfigObjectPatch {
+func generateRouteConfigUration(svcPort corev1.ServicePort, fenceNamespace string) *v1alpha3.EnvoyFilter_EnvoyConfigObjectPatch {
 	config := &v1alpha3.EnvoyFilter_EnvoyConfigObjectPatch{
 		ApplyTo: v1alpha3.EnvoyFilter_ROUTE_CONFIGURATION,
 		Match: &v1alpha3.EnvoyFilter_EnvoyConfigObjectMatch{
@@ -221,7 +281,7 @@ func generateRouteConfigUration(svcPort corev1.ServicePort) *v1alpha3.EnvoyFilte
 																						Kind: &structpb.Value_StructValue{
 																							StructValue: &structpb.Struct{
 																								Fields: map[string]*structpb.Value{
-																									"cluster": {Kind: &structpb.Value_StringValue{StringValue: "outbound|80||fence-proxy.fence.svc.cluster.local"}},
+																									"cluster": {Kind: &structpb.Value_StringValue{StringValue: FenceProxyCluster(fenceNamespace, svcPort.Port)}},
 																									"timeout": {Kind: &structpb.Value_StringValue{StringValue: "0s"}},
 																								},
 																							},
@@ -250,6 +310,26 @@ func generateRouteConfigUration(svcPort corev1.ServicePort) *v1alpha3.EnvoyFilte
 	return config
 }
 
+// setFenceProxyCluster sets the cluster of the fence-proxy routes of svcPort to cluster.
+func setFenceProxyCluster(envoyFilter *v1alpha3.EnvoyFilter, svcPort corev1.ServicePort, cluster string) {
+	for _, patche := range envoyFilter.ConfigPatches {
+		if patche.ApplyTo != v1alpha3.EnvoyFilter_ROUTE_CONFIGURATION || patche.Match.GetRouteConfiguration().GetName() != strconv.Itoa(int(svcPort.Port)) {
+			continue
+		}
+		for _, vh := range patche.Patch.GetValue().GetFields()["virtual_hosts"].GetListValue().GetValues() {
+			if vh.GetStructValue().GetFields()["name"].GetStringValue() != fenceProxyVhost.Name {
+				continue
+			}
+			for _, route := range vh.GetStructValue().GetFields()["routes"].GetListValue().GetValues() {
+				value := route.GetStructValue().GetFields()["route"].GetStructValue().GetFields()["cluster"]
+				if strings.HasPrefix(value.GetStringValue(), "outbound|") && strings.Contains(value.GetStringValue(), "||fence-proxy.") {
+					value.Kind = &structpb.Value_StringValue{StringValue: cluster}
+				}
+			}
+		}
+	}
+}
+
 func generateRouteConfigUrationAllowAnyNew(svcPort corev1.ServicePort) *v1alpha3.EnvoyFilter_EnvoyConfigObjectPatch {
 	config := &v1alpha3.EnvoyFilter_EnvoyConfigObjectPatch{
 		ApplyTo: v1alpha3.EnvoyFilter_ROUTE_CONFIGURATION,
@@ -498,7 +578,7 @@ func alreadyAllowAnyNewRouteConfigUration(envoyFilter *v1alpha3.EnvoyFilter, svc
 func alreadyHttpFilter(envoyFilter *v1alpha3.EnvoyFilter, svcPort corev1.ServicePort) bool {
 	for _, patche := range envoyFilter.ConfigPatches {
 		if patche.ApplyTo == v1alpha3.EnvoyFilter_HTTP_FILTER &&
-			patche.Match.GetListener().GetFilterChain().GetFilter().GetName() == fmt.Sprintf("0.0.0.0_%v", svcPort.Port) {
+			patche.Match.GetListener().GetName() == fmt.Sprintf("0.0.0.0_%v", svcPort.Port) {
 			return true
 		}
 	}
@@ -585,6 +665,27 @@ func AddExternalServiceToRouteConfigUration(authority string, envoyFilter *netwo
 	}
 }
 
+// ExternalHosts returns the external hosts routed by the route configuration patches of port, as
+// added by AddExternalServiceToRouteConfigUration.
+func ExternalHosts(patches []*v1alpha3.EnvoyFilter_EnvoyConfigObjectPatch, port int32) []string {
+	hosts := []string{}
+	for _, patche := range patches {
+		if patche.ApplyTo != v1alpha3.EnvoyFilter_ROUTE_CONFIGURATION || patche.Match.GetRouteConfiguration().GetName() != strconv.Itoa(int(port)) {
+			continue
+		}
+		for _, vh := range patche.Patch.GetValue().GetFields()["virtual_hosts"].GetListValue().GetValues() {
+			switch vh.GetStructValue().GetFields()["name"].GetStringValue() {
+			case fenceProxyVhost.Name, "allow_any_new":
+				continue
+			}
+			for _, domain := range vh.GetStructValue().GetFields()["domains"].GetListValue().GetValues() {
+				hosts = append(hosts, domain.GetStringValue())
+			}
+		}
+	}
+	return hosts
+}
+
 func alreadyExistVirtualHosts(vhs *structpb.Value, domain string) bool {
 	for _, vhItem := range vhs.GetListValue().Values {
 		domains, ok := vhItem.GetStructValue().Fields["domains"]
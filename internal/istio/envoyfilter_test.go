@@ -0,0 +1,59 @@
+package istio
+
+import (
+	"reflect"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fenceProxyClusters returns the clusters of the fence-proxy routes of envoyFilter.
+func fenceProxyClusters(envoyFilter *v1alpha3.EnvoyFilter) []string {
+	var clusters []string
+	for _, patche := range envoyFilter.ConfigPatches {
+		if patche.ApplyTo != v1alpha3.EnvoyFilter_ROUTE_CONFIGURATION {
+			continue
+		}
+		for _, vh := range patche.Patch.GetValue().GetFields()["virtual_hosts"].GetListValue().GetValues() {
+			if vh.GetStructValue().GetFields()["name"].GetStringValue() != fenceProxyVhost.Name {
+				continue
+			}
+			for _, route := range vh.GetStructValue().GetFields()["routes"].GetListValue().GetValues() {
+				clusters = append(clusters, route.GetStructValue().GetFields()["route"].GetStructValue().GetFields()["cluster"].GetStringValue())
+			}
+		}
+	}
+	return clusters
+}
+
+func TestMergeFenceProxyEnvoyFilterRoutesToPort(t *testing.T) {
+	envoyFilter := &v1alpha3.EnvoyFilter{}
+	MergeFenceProxyEnvoyFilter(envoyFilter, corev1.ServicePort{Port: 9080}, "fence-system")
+
+	want := []string{"PassthroughCluster", "outbound|9080||fence-proxy.fence-system.svc.cluster.local"}
+	if got := fenceProxyClusters(envoyFilter); !reflect.DeepEqual(got, want) {
+		t.Errorf("clusters = %v, want %v", got, want)
+	}
+}
+
+func TestMergeFenceProxyEnvoyFilterFixesLegacyRoute(t *testing.T) {
+	// the route configuration written by older versions, to port 80 of fence-proxy in the fence namespace
+	envoyFilter := &v1alpha3.EnvoyFilter{ConfigPatches: []*v1alpha3.EnvoyFilter_EnvoyConfigObjectPatch{
+		generateRouteConfigUration(corev1.ServicePort{Port: 9080}, "fence"),
+	}}
+	setFenceProxyCluster(envoyFilter, corev1.ServicePort{Port: 9080}, "outbound|80||fence-proxy.fence.svc.cluster.local")
+
+	MergeFenceProxyEnvoyFilter(envoyFilter, corev1.ServicePort{Port: 9080}, "fence-system")
+	want := []string{"PassthroughCluster", "outbound|9080||fence-proxy.fence-system.svc.cluster.local"}
+	if got := fenceProxyClusters(envoyFilter); !reflect.DeepEqual(got, want) {
+		t.Errorf("clusters = %v, want %v", got, want)
+	}
+
+	// merging again changes nothing
+	patches := len(envoyFilter.ConfigPatches)
+	MergeFenceProxyEnvoyFilter(envoyFilter, corev1.ServicePort{Port: 9080}, "fence-system")
+	if len(envoyFilter.ConfigPatches) != patches {
+		t.Errorf("len(ConfigPatches) = %v, want %v", len(envoyFilter.ConfigPatches), patches)
+	}
+}
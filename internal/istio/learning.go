@@ -0,0 +1,92 @@
+package istio
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hexiaodai/fence/internal/config"
+	"google.golang.org/protobuf/types/known/structpb"
+	"istio.io/api/networking/v1alpha3"
+	networkingv1alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// LearningEnvoyFilterName returns the name of the EnvoyFilter of a workload in learning mode.
+func LearningEnvoyFilterName(workload string) string {
+	return fmt.Sprintf("fence-learning-%v", workload)
+}
+
+// WorkloadOfLearningEnvoyFilter returns the workload of the learning EnvoyFilter name.
+func WorkloadOfLearningEnvoyFilter(name string) (string, bool) {
+	workload := strings.TrimPrefix(name, LearningEnvoyFilterName(""))
+	return workload, workload != name && workload != ""
+}
+
+// GenerateLearningEnvoyFilter returns the EnvoyFilter which sends the outbound HTTP access logs of
+// the workload nn to fence. Without a Sidecar, the requests of the workload do not go through
+// fence-proxy, so its dependencies are learned from its own access logs.
+func (s *Sidecar) GenerateLearningEnvoyFilter(nn types.NamespacedName, selector map[string]string) (*networkingv1alpha3.EnvoyFilter, error) {
+	value, err := structpb.NewStruct(map[string]interface{}{
+		"typed_config": map[string]interface{}{
+			"@type": "type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager",
+			"access_log": []interface{}{
+				map[string]interface{}{
+					"name": "envoy.access_loggers.http_grpc",
+					"typed_config": map[string]interface{}{
+						"@type": "type.googleapis.com/envoy.extensions.access_loggers.grpc.v3.HttpGrpcAccessLogConfig",
+						"common_config": map[string]interface{}{
+							"grpc_service": map[string]interface{}{
+								"envoy_grpc": map[string]interface{}{
+									"cluster_name": fmt.Sprintf("outbound|%v||fence.%v.svc.cluster.local", s.LogSourcePort, s.FenceNamespace),
+								},
+							},
+							"log_name":              "http_envoy_accesslog",
+							"transport_api_version": "V3",
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	envoyFilter := &networkingv1alpha3.EnvoyFilter{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      LearningEnvoyFilterName(nn.Name),
+			Namespace: nn.Namespace,
+			Labels: map[string]string{
+				config.ManagedByLabel: config.ManagedByValue,
+			},
+		},
+		Spec: v1alpha3.EnvoyFilter{
+			WorkloadSelector: &v1alpha3.WorkloadSelector{
+				Labels: selector,
+			},
+			ConfigPatches: []*v1alpha3.EnvoyFilter_EnvoyConfigObjectPatch{
+				{
+					ApplyTo: v1alpha3.EnvoyFilter_NETWORK_FILTER,
+					Match: &v1alpha3.EnvoyFilter_EnvoyConfigObjectMatch{
+						Context: v1alpha3.EnvoyFilter_SIDECAR_OUTBOUND,
+						ObjectTypes: &v1alpha3.EnvoyFilter_EnvoyConfigObjectMatch_Listener{
+							Listener: &v1alpha3.EnvoyFilter_ListenerMatch{
+								FilterChain: &v1alpha3.EnvoyFilter_ListenerMatch_FilterChainMatch{
+									Filter: &v1alpha3.EnvoyFilter_ListenerMatch_FilterMatch{
+										Name: "envoy.filters.network.http_connection_manager",
+									},
+								},
+							},
+						},
+					},
+					Patch: &v1alpha3.EnvoyFilter_Patch{
+						Operation: v1alpha3.EnvoyFilter_Patch_MERGE,
+						Value:     value,
+					},
+				},
+			},
+		},
+	}
+	return envoyFilter, nil
+}
@@ -3,14 +3,15 @@ package istio
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	data_accesslog "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
 	icache "github.com/hexiaodai/fence/internal/cache"
 	"github.com/hexiaodai/fence/internal/config"
 	istio "istio.io/api/networking/v1alpha3"
 	networkingv1alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
-	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 var (
@@ -26,18 +27,22 @@ func NewSidecar(ipServiceCache *icache.IpService, server config.Server) *Sidecar
 	return &Sidecar{ipServiceCache: ipServiceCache, Server: server}
 }
 
-func (s *Sidecar) Generate(svc *corev1.Service) (*networkingv1alpha3.Sidecar, error) {
-	if len(svc.Spec.Selector) == 0 {
+// Generate returns the Sidecar of the workload nn, which selects its pods by selector.
+func (s *Sidecar) Generate(nn types.NamespacedName, selector map[string]string) (*networkingv1alpha3.Sidecar, error) {
+	if len(selector) == 0 {
 		return nil, ErrNoLabelSelector
 	}
 	sidecar := &networkingv1alpha3.Sidecar{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      svc.Name,
-			Namespace: svc.Namespace,
+			Name:      nn.Name,
+			Namespace: nn.Namespace,
+			Labels: map[string]string{
+				config.ManagedByLabel: config.ManagedByValue,
+			},
 		},
 		Spec: istio.Sidecar{
 			WorkloadSelector: &istio.WorkloadSelector{
-				Labels: svc.Spec.Selector,
+				Labels: selector,
 			},
 			Egress: s.generateDefaultEgress(),
 		},
@@ -56,25 +61,83 @@ func (s *Sidecar) generateDefaultEgress() []*istio.IstioEgressListener {
 	}
 }
 
-func (s *Sidecar) AddDestinationSvcToEgress(sidecar *networkingv1alpha3.Sidecar, entry *data_accesslog.HTTPAccessLogEntry) error {
+// DestinationSvc returns the destination service of entry.
+func (s *Sidecar) DestinationSvc(entry *data_accesslog.HTTPAccessLogEntry) (string, error) {
 	destSvc, err := s.ipServiceCache.FetchDestinationSvc(entry)
 	if err != nil {
-		return fmt.Errorf("get destination domain error, error: %v", err)
+		return "", fmt.Errorf("get destination domain error, error: %v", err)
 	}
-	hostIndexer := map[string]struct{}{}
+	return destSvc, nil
+}
+
+// AddHostsToEgress adds hosts to the egress hosts of sidecar. It reports whether sidecar was changed.
+func (s *Sidecar) AddHostsToEgress(sidecar *networkingv1alpha3.Sidecar, hosts ...string) bool {
 	egress := sidecar.Spec.Egress
 	if len(egress) == 0 {
 		egress = s.generateDefaultEgress()
+		sidecar.Spec.Egress = egress
 	}
+	hostIndexer := map[string]struct{}{}
 	for _, host := range egress[0].Hosts {
 		hostIndexer[host] = struct{}{}
 	}
-	hostIndexer[fmt.Sprintf("*/%v", destSvc)] = struct{}{}
+	changed := false
+	for _, host := range hosts {
+		if _, ok := hostIndexer[host]; ok {
+			continue
+		}
+		hostIndexer[host] = struct{}{}
+		egress[0].Hosts = append(egress[0].Hosts, host)
+		changed = true
+	}
+	return changed
+}
+
+// RemoveHostsFromEgress removes hosts from the egress hosts of sidecar, and returns the removed hosts.
+func (s *Sidecar) RemoveHostsFromEgress(sidecar *networkingv1alpha3.Sidecar, hosts ...string) []string {
+	if len(sidecar.Spec.Egress) == 0 {
+		return nil
+	}
+	removeIndexer := map[string]struct{}{}
+	for _, host := range hosts {
+		removeIndexer[host] = struct{}{}
+	}
+	removed := []string{}
+	kept := []string{}
+	for _, host := range sidecar.Spec.Egress[0].Hosts {
+		if _, ok := removeIndexer[host]; ok {
+			removed = append(removed, host)
+			continue
+		}
+		kept = append(kept, host)
+	}
+	sidecar.Spec.Egress[0].Hosts = kept
+	return removed
+}
+
+// LearnedHosts returns the egress hosts of sidecar that were learned from access logs.
+func LearnedHosts(sidecar *networkingv1alpha3.Sidecar) []string {
+	if len(sidecar.Spec.Egress) == 0 {
+		return nil
+	}
 	hosts := []string{}
-	for host := range hostIndexer {
-		hosts = append(hosts, host)
+	for _, host := range sidecar.Spec.Egress[0].Hosts {
+		if _, ok := DestinationOfHost(host); ok {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// EgressHost returns the Sidecar egress host of destination service.
+func EgressHost(destSvc string) string {
+	return fmt.Sprintf("*/%v", destSvc)
+}
+
+// DestinationOfHost returns the destination service of the Sidecar egress host.
+func DestinationOfHost(host string) (string, bool) {
+	if !strings.HasPrefix(host, "*/") || host == "*/*" {
+		return "", false
 	}
-	egress[0].Hosts = hosts
-	sidecar.Spec.Egress = egress
-	return nil
+	return strings.TrimPrefix(host, "*/"), true
 }
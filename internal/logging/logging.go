@@ -2,6 +2,7 @@ package logging
 
 import (
 	"os"
+	"sync"
 
 	"github.com/go-logr/logr"
 	"github.com/go-logr/zapr"
@@ -22,6 +23,10 @@ type Logging struct {
 	// Level is the logging level. If unspecified, defaults to "info".
 	// LogLevel options: debug/info/error/warn.
 	Level LogLevel
+
+	// atomicLevel is shared by every Logger of the Logging, so that SetLevel applies to all of them
+	atomicLevel zap.AtomicLevel
+	once        sync.Once
 }
 
 func DefaultLogging() *Logging {
@@ -35,7 +40,7 @@ type Logger struct {
 }
 
 func NewLogger(logging *Logging) Logger {
-	logger := initZapLogger(logging, logging.Level)
+	logger := initZapLogger(logging)
 	return Logger{
 		Logger:        zapr.NewLogger(logger),
 		logging:       logging,
@@ -44,8 +49,8 @@ func NewLogger(logging *Logging) Logger {
 }
 
 func DefaultLogger(level LogLevel) Logger {
-	logging := DefaultLogging()
-	logger := initZapLogger(logging, level)
+	logging := &Logging{Level: level}
+	logger := initZapLogger(logging)
 
 	return Logger{
 		Logger:        zapr.NewLogger(logger),
@@ -60,8 +65,7 @@ func DefaultLogger(level LogLevel) Logger {
 // contain only letters, digits, and hyphens (see the package documentation for
 // more information).
 func (l Logger) WithName(name string) Logger {
-	logLevel := l.logging.Level
-	logger := initZapLogger(l.logging, logLevel)
+	logger := initZapLogger(l.logging)
 	return Logger{
 		Logger:        zapr.NewLogger(logger).WithName(name),
 		logging:       l.logging,
@@ -98,9 +102,22 @@ func (l Logger) Sugar() *zap.SugaredLogger {
 	return l.sugaredLogger
 }
 
-func initZapLogger(logging *Logging, level LogLevel) *zap.Logger {
+// SetLevel changes the level of the Logger, and of every Logger derived from the same Logging.
+func (l Logger) SetLevel(level LogLevel) {
 	parseLevel, _ := zapcore.ParseLevel(string(level))
-	core := zapcore.NewCore(zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig()), zapcore.AddSync(os.Stdout), zap.NewAtomicLevelAt(parseLevel))
+	l.logging.level().SetLevel(parseLevel)
+}
+
+func (l *Logging) level() zap.AtomicLevel {
+	l.once.Do(func() {
+		parseLevel, _ := zapcore.ParseLevel(string(l.Level))
+		l.atomicLevel = zap.NewAtomicLevelAt(parseLevel)
+	})
+	return l.atomicLevel
+}
+
+func initZapLogger(logging *Logging) *zap.Logger {
+	core := zapcore.NewCore(zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig()), zapcore.AddSync(os.Stdout), logging.level())
 
 	return zap.New(core, zap.AddCaller())
 }
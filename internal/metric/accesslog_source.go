@@ -1,22 +1,31 @@
 package metric
 
 import (
+	"context"
 	"fmt"
 	"net"
 
 	data_accesslog "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
 	service_accesslog "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v3"
 	"github.com/hexiaodai/fence/internal/config"
+	"github.com/hexiaodai/fence/internal/monitoring"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
 )
 
 type HttpLogEntry interface {
 	StreamLogEntry([]*data_accesslog.HTTPAccessLogEntry)
 }
 
+type TcpLogEntry interface {
+	StreamTCPLogEntry([]*data_accesslog.TCPAccessLogEntry)
+}
+
 type AccessLogSource struct {
 	servePort    string
+	queue        *fairQueue
 	httpLogEntry HttpLogEntry
+	tcpLogEntry  TcpLogEntry
 	config.Server
 }
 
@@ -28,6 +37,7 @@ func NewAccessLogSource(servePort string, server config.Server) (*AccessLogSourc
 	source := &AccessLogSource{
 		Server:    server,
 		servePort: servePort,
+		queue:     newFairQueue(server.AccessLogQueueSize),
 	}
 	source.Logger = source.Logger.WithName(source.Name()).WithValues("metric", source.Name())
 	return source, nil
@@ -37,23 +47,61 @@ func (s *AccessLogSource) RegisterHttpLogEntry(h HttpLogEntry) {
 	s.httpLogEntry = h
 }
 
-// StreamAccessLogs accept access log from fence xds egress gateway
+func (s *AccessLogSource) RegisterTcpLogEntry(t TcpLogEntry) {
+	s.tcpLogEntry = t
+}
+
+// StreamAccessLogs accept access log from fence xds egress gateway. The messages are queued for
+// the workers, so that a slow API server does not block the log stream of Envoy.
 func (s *AccessLogSource) StreamAccessLogs(logServer service_accesslog.AccessLogService_StreamAccessLogsServer) error {
+	source := ""
+	if p, ok := peer.FromContext(logServer.Context()); ok {
+		source = p.Addr.String()
+	}
 	for {
 		message, err := logServer.Recv()
 		if err != nil {
 			return err
 		}
+		// the identifier is only sent with the first message of the stream
+		if id := message.GetIdentifier().GetNode().GetId(); id != "" {
+			source = id
+		}
 
-		httpLogEntries := message.GetHttpLogs()
-		if httpLogEntries != nil && s.httpLogEntry != nil {
-			s.httpLogEntry.StreamLogEntry(httpLogEntries.LogEntry)
+		b := logBatch{source: source}
+		if httpLogEntries := message.GetHttpLogs(); httpLogEntries != nil && s.httpLogEntry != nil {
+			b.http = httpLogEntries.LogEntry
+			monitoring.AccessLogEntriesReceived.WithLabelValues(monitoring.ProtocolHTTP).Add(float64(len(b.http)))
+		}
+		if tcpLogEntries := message.GetTcpLogs(); tcpLogEntries != nil && s.tcpLogEntry != nil {
+			b.tcp = tcpLogEntries.LogEntry
+			monitoring.AccessLogEntriesReceived.WithLabelValues(monitoring.ProtocolTCP).Add(float64(len(b.tcp)))
+		}
+		if len(b.http) == 0 && len(b.tcp) == 0 {
+			continue
 		}
+		s.queue.push(b)
 	}
 }
 
-// Start grpc server
-func (s *AccessLogSource) Start() error {
+// work processes the queued messages until the queue is closed.
+func (s *AccessLogSource) work() {
+	for {
+		b, ok := s.queue.pop()
+		if !ok {
+			return
+		}
+		if len(b.http) > 0 {
+			s.httpLogEntry.StreamLogEntry(b.http)
+		}
+		if len(b.tcp) > 0 {
+			s.tcpLogEntry.StreamTCPLogEntry(b.tcp)
+		}
+	}
+}
+
+// Start grpc server, and the workers until ctx is done
+func (s *AccessLogSource) Start(ctx context.Context) error {
 	listen, err := net.Listen("tcp", fmt.Sprintf(":%v", s.servePort))
 	if err != nil {
 		return err
@@ -68,6 +116,15 @@ func (s *AccessLogSource) Start() error {
 		}
 	}()
 
-	s.Logger.Info("accessLogSource server is starting to listen", "addr", s.servePort)
+	for i := 0; i < s.AccessLogWorkers; i++ {
+		go s.work()
+	}
+	go func() {
+		<-ctx.Done()
+		server.Stop()
+		s.queue.close()
+	}()
+
+	s.Logger.Info("accessLogSource server is starting to listen", "addr", s.servePort, "workers", s.AccessLogWorkers, "queueSize", s.AccessLogQueueSize)
 	return nil
 }
@@ -0,0 +1,128 @@
+package metric
+
+import (
+	"sync"
+
+	data_accesslog "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+	"github.com/hexiaodai/fence/internal/monitoring"
+)
+
+// logBatch holds the access log entries of one message of a log stream.
+type logBatch struct {
+	source string
+	http   []*data_accesslog.HTTPAccessLogEntry
+	tcp    []*data_accesslog.TCPAccessLogEntry
+}
+
+// fairQueue is a bounded queue of log batches, served round robin across the sources, so that
+// a noisy sidecar does not delay the logs of the others. When it is full, the oldest batch of
+// the source with the most queued batches is dropped.
+type fairQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	size   int
+	len    int
+	queues map[string][]logBatch
+	// sources are the sources with queued batches, in round robin order
+	sources []string
+	next    int
+	closed  bool
+}
+
+func newFairQueue(size int) *fairQueue {
+	if size < 1 {
+		size = 1
+	}
+	q := &fairQueue{
+		size:   size,
+		queues: map[string][]logBatch{},
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push queues b without blocking.
+func (q *fairQueue) push(b logBatch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	if q.len >= q.size {
+		largest := -1
+		for i, source := range q.sources {
+			if largest < 0 || len(q.queues[source]) > len(q.queues[q.sources[largest]]) {
+				largest = i
+			}
+		}
+		if largest < 0 || len(q.queues[q.sources[largest]]) <= len(q.queues[b.source]) {
+			countDropped(b)
+			return
+		}
+		dropped, _ := q.dequeue(largest)
+		countDropped(dropped)
+	}
+
+	if len(q.queues[b.source]) == 0 {
+		q.sources = append(q.sources, b.source)
+	}
+	q.queues[b.source] = append(q.queues[b.source], b)
+	q.len++
+	monitoring.AccessLogQueueLength.Set(float64(q.len))
+	q.cond.Signal()
+}
+
+// pop returns the next batch, and blocks until there is one. It returns false once the queue
+// is closed.
+func (q *fairQueue) pop() (logBatch, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.len == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return logBatch{}, false
+	}
+
+	q.next %= len(q.sources)
+	b, left := q.dequeue(q.next)
+	if left {
+		q.next++
+	}
+	monitoring.AccessLogQueueLength.Set(float64(q.len))
+	return b, true
+}
+
+// dequeue removes the oldest batch of the i-th source, and reports whether the source has
+// batches left. A source without batches leaves the round robin.
+func (q *fairQueue) dequeue(i int) (logBatch, bool) {
+	source := q.sources[i]
+	b := q.queues[source][0]
+	q.queues[source] = q.queues[source][1:]
+	q.len--
+	if len(q.queues[source]) > 0 {
+		return b, true
+	}
+	delete(q.queues, source)
+	q.sources = append(q.sources[:i], q.sources[i+1:]...)
+	if i < q.next {
+		q.next--
+	}
+	return b, false
+}
+
+// close wakes up the workers, and drops the batches left.
+func (q *fairQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+func countDropped(b logBatch) {
+	monitoring.AccessLogEntriesDropped.WithLabelValues(monitoring.ProtocolHTTP, monitoring.ReasonQueueFull).Add(float64(len(b.http)))
+	monitoring.AccessLogEntriesDropped.WithLabelValues(monitoring.ProtocolTCP, monitoring.ReasonQueueFull).Add(float64(len(b.tcp)))
+}
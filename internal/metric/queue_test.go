@@ -0,0 +1,111 @@
+package metric
+
+import (
+	"fmt"
+	"testing"
+)
+
+func popSources(t *testing.T, q *fairQueue, n int) []string {
+	t.Helper()
+	sources := []string{}
+	for i := 0; i < n; i++ {
+		b, ok := q.pop()
+		if !ok {
+			t.Fatalf("pop %v: queue closed", i)
+		}
+		sources = append(sources, b.source)
+	}
+	return sources
+}
+
+func TestFairQueueRoundRobin(t *testing.T) {
+	q := newFairQueue(10)
+	for i := 0; i < 3; i++ {
+		q.push(logBatch{source: "noisy"})
+	}
+	q.push(logBatch{source: "quiet"})
+
+	got := fmt.Sprint(popSources(t, q, 4))
+	if want := "[noisy quiet noisy noisy]"; got != want {
+		t.Errorf("pop order = %v, want %v", got, want)
+	}
+}
+
+func TestFairQueueEvictsLargestSource(t *testing.T) {
+	q := newFairQueue(3)
+	q.push(logBatch{source: "noisy"})
+	q.push(logBatch{source: "noisy"})
+	q.push(logBatch{source: "quiet"})
+	q.push(logBatch{source: "other"})
+
+	if q.len != 3 {
+		t.Fatalf("len = %v, want 3", q.len)
+	}
+	got := fmt.Sprint(popSources(t, q, 3))
+	if want := "[noisy quiet other]"; got != want {
+		t.Errorf("pop order = %v, want %v", got, want)
+	}
+}
+
+func TestFairQueueDropsIncomingOfLargestSource(t *testing.T) {
+	q := newFairQueue(2)
+	q.push(logBatch{source: "noisy"})
+	q.push(logBatch{source: "quiet"})
+	q.push(logBatch{source: "noisy"})
+
+	got := fmt.Sprint(popSources(t, q, 2))
+	if want := "[noisy quiet]"; got != want {
+		t.Errorf("pop order = %v, want %v", got, want)
+	}
+}
+
+// More sources than batches: every eviction empties a source, which must leave the round robin.
+func TestFairQueueEvictsSingleBatchSources(t *testing.T) {
+	const size = 4
+	q := newFairQueue(size)
+	for i := 0; i < 3*size; i++ {
+		q.push(logBatch{source: fmt.Sprintf("source-%v", i)})
+		if q.len > size {
+			t.Fatalf("len = %v, want at most %v", q.len, size)
+		}
+		if len(q.sources) != len(q.queues) {
+			t.Fatalf("%v sources in the round robin, %v queued", len(q.sources), len(q.queues))
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, source := range popSources(t, q, size) {
+		if seen[source] {
+			t.Errorf("source %v popped twice", source)
+		}
+		seen[source] = true
+	}
+	if q.len != 0 || len(q.sources) != 0 || len(q.queues) != 0 {
+		t.Errorf("queue not empty: len %v, sources %v, queues %v", q.len, q.sources, q.queues)
+	}
+}
+
+func TestFairQueueEvictionKeepsRoundRobin(t *testing.T) {
+	q := newFairQueue(3)
+	q.push(logBatch{source: "x"})
+	q.push(logBatch{source: "x"})
+	q.push(logBatch{source: "y"})
+	// x is served, the round robin points to y
+	popSources(t, q, 1)
+	q.size = 2
+	// evicts the last batch of x, before y in the round robin
+	q.push(logBatch{source: "z"})
+
+	got := fmt.Sprint(popSources(t, q, 2))
+	if want := "[y z]"; got != want {
+		t.Errorf("pop order = %v, want %v", got, want)
+	}
+}
+
+func TestFairQueueClose(t *testing.T) {
+	q := newFairQueue(1)
+	q.close()
+	if _, ok := q.pop(); ok {
+		t.Error("pop on a closed queue returned a batch")
+	}
+}
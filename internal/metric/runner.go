@@ -21,7 +21,7 @@ func (r *Runner) Start(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	if err := accessLogSource.Start(); err != nil {
+	if err := accessLogSource.Start(ctx); err != nil {
 		return err
 	}
 
@@ -34,3 +34,7 @@ func (r *Runner) Start(ctx context.Context) error {
 func (r *Runner) RegisterHttpLogEntry(h HttpLogEntry) {
 	r.accessLogSource.RegisterHttpLogEntry(h)
 }
+
+func (r *Runner) RegisterTcpLogEntry(t TcpLogEntry) {
+	r.accessLogSource.RegisterTcpLogEntry(t)
+}
@@ -0,0 +1,123 @@
+package monitoring
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	ProtocolHTTP = "http"
+	ProtocolTCP  = "tcp"
+
+	OperationCreate = "create"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+
+	// the reasons access log entries are dropped for
+	ReasonNoSource          = "no_source"
+	ReasonNoDestination     = "no_destination"
+	ReasonExcludedNamespace = "excluded_namespace"
+	ReasonConflict          = "conflict"
+	ReasonError             = "error"
+	ReasonQueueFull         = "queue_full"
+)
+
+var (
+	AccessLogEntriesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "fence",
+		Name:      "accesslog_entries_received_total",
+		Help:      "Number of access log entries received.",
+	}, []string{"protocol"})
+
+	AccessLogEntriesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "fence",
+		Name:      "accesslog_entries_dropped_total",
+		Help:      "Number of access log entries dropped, per reason.",
+	}, []string{"protocol", "reason"})
+
+	AccessLogEntriesProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "fence",
+		Name:      "accesslog_entries_processed_total",
+		Help:      "Number of access log entries processed.",
+	}, []string{"protocol"})
+
+	AccessLogQueueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "fence",
+		Name:      "accesslog_queue_length",
+		Help:      "Number of access log messages waiting to be processed.",
+	})
+
+	SidecarWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "fence",
+		Name:      "sidecar_writes_total",
+		Help:      "Number of Sidecars created, updated and deleted.",
+	}, []string{"operation"})
+
+	ConflictRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "fence",
+		Name:      "accesslog_conflict_retries_total",
+		Help:      "Number of retries of Sidecar updates from access log entries after a conflict.",
+	}, []string{"protocol"})
+
+	EnvoyFilterConfigPatches = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "fence",
+		Name:      "envoyfilter_config_patches",
+		Help:      "Number of config patches of the EnvoyFilters managed by Fence.",
+	}, []string{"namespace", "name"})
+
+	DependencyExternalEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "fence",
+		Name:      "dependency_external_evictions_total",
+		Help:      "Number of external destinations evicted from the dependency graph, over the maxExternalDestinations limit.",
+	})
+
+	DependencyStoreBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "fence",
+		Name:      "dependency_store_bytes",
+		Help:      "Size of the dependencies last written to the ConfigMap store, in bytes.",
+	})
+
+	DependencyStoreOverflows = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "fence",
+		Name:      "dependency_store_overflows_total",
+		Help:      "Number of dependency saves over the ConfigMap size limit, which left out the least recently seen dependencies.",
+	})
+
+	ProxyRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "fence",
+		Name:      "proxy_requests_total",
+		Help:      "Number of requests served by the wormhole proxy, per port and response code.",
+	}, []string{"port", "code"})
+
+	ProxyRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "fence",
+		Name:      "proxy_request_duration_seconds",
+		Help:      "Latency of the requests served by the wormhole proxy, per port.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"port"})
+
+	ProxyUpstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "fence",
+		Name:      "proxy_upstream_errors_total",
+		Help:      "Number of requests of the wormhole proxy which failed to reach the upstream, per port.",
+	}, []string{"port"})
+)
+
+func init() {
+	// the controller-runtime registry also holds the controller and client metrics
+	ctrlmetrics.Registry.MustRegister(
+		AccessLogEntriesReceived,
+		AccessLogEntriesDropped,
+		AccessLogEntriesProcessed,
+		AccessLogQueueLength,
+		SidecarWrites,
+		ConflictRetries,
+		EnvoyFilterConfigPatches,
+		DependencyExternalEvictions,
+		DependencyStoreBytes,
+		DependencyStoreOverflows,
+		ProxyRequests,
+		ProxyRequestDuration,
+		ProxyUpstreamErrors,
+	)
+}
@@ -0,0 +1,40 @@
+package monitoring
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/hexiaodai/fence/internal/config"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+func New(server config.Server) *Runner {
+	server.Logger = server.Logger.WithName("Runner").WithValues("monitoring", "Runner")
+	return &Runner{Server: server}
+}
+
+// Runner serves the Prometheus metrics on MetricsPort.
+type Runner struct {
+	config.Server
+}
+
+func (r *Runner) Start() error {
+	if r.MetricsPort == r.WormholePort || r.MetricsPort == r.ProbePort {
+		return fmt.Errorf("metrics port is conflict with wormholePort or probePort. conflict port is %v", r.MetricsPort)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(ctrlmetrics.Registry, promhttp.HandlerOpts{}))
+
+	addr := fmt.Sprintf(":%v", r.MetricsPort)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			r.Logger.Error(err, "failed to start metrics listener", "addr", r.MetricsPort)
+			return
+		}
+	}()
+
+	r.Logger.Info("started", "addr", r.MetricsPort)
+	return nil
+}
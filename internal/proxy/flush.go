@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// flushInterval returns how often the response is flushed to the client while it is copied.
+// A negative interval flushes after each write, zero never flushes before the end.
+func (h *HttpProxy) flushInterval(req *http.Request, resp *http.Response) time.Duration {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	// Server-Sent Events
+	case mediaType == "text/event-stream":
+		return -1
+	// gRPC and other streams over HTTP/2 are forwarded message by message
+	case mediaType == "application/grpc" || req.ProtoMajor == 2 && resp.ContentLength == -1:
+		return -1
+	}
+	return h.Current().ProxyFlushInterval
+}
+
+// copyResponse copies src to w, flushing w every interval.
+func copyResponse(w http.ResponseWriter, src io.Reader, interval time.Duration) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok || interval == 0 {
+		_, err := io.Copy(w, src)
+		return err
+	}
+	if interval < 0 {
+		return copyAndFlush(w, flusher, src)
+	}
+
+	mlw := &maxLatencyWriter{dst: w, flusher: flusher, latency: interval}
+	defer mlw.stop()
+	_, err := io.Copy(mlw, src)
+	return err
+}
+
+// copyAndFlush copies src to w, flushing w after each write.
+func copyAndFlush(w io.Writer, flusher http.Flusher, src io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// maxLatencyWriter flushes the data written to dst at most latency after it was written.
+type maxLatencyWriter struct {
+	dst     io.Writer
+	flusher http.Flusher
+	latency time.Duration
+
+	mu           sync.Mutex
+	timer        *time.Timer
+	flushPending bool
+}
+
+func (m *maxLatencyWriter) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.dst.Write(p)
+	if m.flushPending {
+		return n, err
+	}
+	if m.timer == nil {
+		m.timer = time.AfterFunc(m.latency, m.delayedFlush)
+	} else {
+		m.timer.Reset(m.latency)
+	}
+	m.flushPending = true
+	return n, err
+}
+
+func (m *maxLatencyWriter) delayedFlush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// stop was called in the meantime
+	if !m.flushPending {
+		return
+	}
+	m.flusher.Flush()
+	m.flushPending = false
+}
+
+func (m *maxLatencyWriter) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.flushPending = false
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// viaPseudonym names fence-proxy in the Via header.
+const viaPseudonym = "fence-proxy"
+
+// hopHeaders are the hop-by-hop headers, which apply to a single connection and are not
+// forwarded by proxies (RFC 9110, section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard, sent by some clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers, including the ones listed in the
+// Connection header.
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// prepareRequestHeader applies the header policy of fence-proxy to a request to the
+// original destination.
+func prepareRequestHeader(req *http.Request) {
+	upgrade := upgradeType(req.Header)
+	// "TE: trailers" tells the upstream that the client accepts trailers, e.g. for gRPC
+	acceptTrailers := headerHasToken(req.Header, "Te", "trailers")
+
+	removeHopHeaders(req.Header)
+
+	// the upgrade is negotiated end to end, see handleUpgrade
+	if upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+	if acceptTrailers {
+		req.Header.Set("Te", "trailers")
+	}
+
+	if clientIp, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			clientIp = strings.Join(prior, ", ") + ", " + clientIp
+		}
+		req.Header.Set("X-Forwarded-For", clientIp)
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", "http")
+	}
+	addVia(req.Header, req.ProtoMajor, req.ProtoMinor)
+}
+
+// prepareResponseHeader applies the header policy of fence-proxy to a response from the
+// original destination.
+func prepareResponseHeader(resp *http.Response) {
+	removeHopHeaders(resp.Header)
+	addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+}
+
+// addVia appends fence-proxy to the Via header, with the protocol version the message
+// was received with.
+func addVia(header http.Header, major, minor int) {
+	protocol := fmt.Sprintf("%d.%d", major, minor)
+	if major >= 2 {
+		protocol = fmt.Sprintf("%d", major)
+	}
+	header.Add("Via", fmt.Sprintf("%v %v", protocol, viaPseudonym))
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			// e.g. "trailers, deflate;q=0.5"
+			if t = strings.TrimSpace(strings.SplitN(t, ";", 2)[0]); strings.EqualFold(t, token) {
+				return true
+			}
+		}
+	}
+	return false
+}
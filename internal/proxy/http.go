@@ -1,16 +1,20 @@
 package proxy
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hexiaodai/fence/internal/cache"
 	"github.com/hexiaodai/fence/internal/config"
+	"github.com/hexiaodai/fence/internal/monitoring"
 	"k8s.io/apimachinery/pkg/types"
 )
 
@@ -19,25 +23,45 @@ const (
 	HeaderOrigDest = "Fence-Orig-Dest"
 )
 
-func NewHttpProxy(wormholePort string, serviceCache *cache.Service, server config.Server) (*HttpProxy, error) {
+func NewHttpProxy(wormholePort string, serviceCache *cache.Service, transportPool *TransportPool, server config.Server) (*HttpProxy, error) {
 	hp := &HttpProxy{
-		Server:       server,
-		wormholePort: wormholePort,
-		serviceCache: serviceCache,
+		Server:        server,
+		wormholePort:  wormholePort,
+		serviceCache:  serviceCache,
+		transportPool: transportPool,
+		closing:       make(chan struct{}),
 	}
 	hp.Logger = server.Logger.WithName("HttpProxy").WithValues("proxy", "HttpProxy")
 	return hp, nil
 }
 
 type HttpProxy struct {
-	wormholePort string
-	serviceCache *cache.Service
+	wormholePort  string
+	serviceCache  *cache.Service
+	transportPool *TransportPool
+	// closing is closed when the listener of the proxy is shut down
+	closing     chan struct{}
+	closingOnce sync.Once
 	config.Server
 }
 
+// closeUpgraded ends the tunnels of the upgraded connections, which are not tracked by the
+// http.Server once hijacked.
+func (h *HttpProxy) closeUpgraded() {
+	h.closingOnce.Do(func() { close(h.closing) })
+}
+
 func (h *HttpProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	h.Logger.Info("request", "proto", req.Proto, "method", req.Method, "host", req.Host)
 
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+	w = recorder
+	defer func() {
+		monitoring.ProxyRequests.WithLabelValues(h.wormholePort, strconv.Itoa(recorder.code)).Inc()
+		monitoring.ProxyRequestDuration.WithLabelValues(h.wormholePort).Observe(time.Since(start).Seconds())
+	}()
+
 	var (
 		reqCtx               = req.Context()
 		reqHost              = req.Host
@@ -116,30 +140,16 @@ func (h *HttpProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	req.URL.Host = reqHost
 	req.Host = reqHost
 	req.RequestURI = ""
+	prepareRequestHeader(req)
 	newCtx, cancel := context.WithCancel(reqCtx)
 	defer cancel()
 	req = req.WithContext(newCtx)
 
-	dialer := &net.Dialer{
-		KeepAlive: 30 * time.Second,
-	}
-	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			newAddr := fmt.Sprintf("%s:%s", origDestIp, origDestPort)
-			return dialer.DialContext(ctx, network, newAddr)
-		},
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}
-	client := &http.Client{
-		Transport: transport,
-	}
-
-	resp, err := client.Do(req)
+	// the redirects are up to the client: the transport always dials the original destination
+	transport := h.transportPool.Get(net.JoinHostPort(strings.Trim(origDestIp, "[]"), origDestPort), req.ProtoMajor == 2)
+	resp, err := transport.RoundTrip(req)
 	if err != nil {
+		monitoring.ProxyUpstreamErrors.WithLabelValues(h.wormholePort).Inc()
 		select {
 		case <-reqCtx.Done():
 		default:
@@ -148,14 +158,152 @@ func (h *HttpProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 		return
 	}
+	// the connection goes back to the pool once the body is closed
+	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		h.handleUpgrade(w, req, resp)
+		return
+	}
+
+	prepareResponseHeader(resp)
 	for k, vv := range resp.Header {
 		for _, v := range vv {
 			w.Header().Add(k, v)
 		}
 	}
+	// announce the trailers, e.g. the grpc-status, which are known once the body is read
+	announcedTrailers := len(resp.Trailer)
+	if announcedTrailers > 0 {
+		trailerKeys := make([]string, 0, len(resp.Trailer))
+		for k := range resp.Trailer {
+			trailerKeys = append(trailerKeys, k)
+		}
+		w.Header().Add("Trailer", strings.Join(trailerKeys, ", "))
+	}
 	w.WriteHeader(resp.StatusCode)
-	if _, err := io.Copy(w, resp.Body); err != nil {
+	// the headers are sent chunked, so that the trailers which were not announced can still
+	// follow a short body. otherwise net/http sends its Content-Length and drops them.
+	if resp.ContentLength == -1 {
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+
+	if err := copyResponse(w, resp.Body, h.flushInterval(req, resp)); err != nil {
 		h.Logger.Info(err.Error())
+		return
+	}
+
+	for k, vv := range resp.Trailer {
+		if len(resp.Trailer) != announcedTrailers {
+			// the trailers which were not announced
+			k = http.TrailerPrefix + k
+		}
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+}
+
+// handleUpgrade tunnels the connection upgraded by the original destination, e.g. a WebSocket,
+// to the client until either side closes it.
+func (h *HttpProxy) handleUpgrade(w http.ResponseWriter, req *http.Request, resp *http.Response) {
+	reqUpgrade := upgradeType(req.Header)
+	respUpgrade := upgradeType(resp.Header)
+	if !strings.EqualFold(reqUpgrade, respUpgrade) {
+		h.Logger.Info("upgrade protocol mismatch", "request", reqUpgrade, "response", respUpgrade)
+		http.Error(w, "", http.StatusBadGateway)
+		return
+	}
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		h.Logger.Info("upgraded response body is not writable")
+		http.Error(w, "", http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		h.Logger.Info("response writer does not support hijacking")
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	// the connection is gone once hijacked. the response is written by hand.
+	addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	resp.Header = w.Header()
+	resp.Body = nil
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		h.Logger.Info(err.Error())
+		return
+	}
+	defer conn.Close()
+	if err := resp.Write(brw); err != nil {
+		h.Logger.Info(err.Error())
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		h.Logger.Info(err.Error())
+		return
+	}
+
+	h.Logger.Info("upgraded", "protocol", respUpgrade, "host", req.Host)
+	errc := make(chan error, 2)
+	go tunnel(backConn, brw, errc)
+	go tunnel(conn, backConn, errc)
+	select {
+	case err := <-errc:
+		if err != nil && err != io.EOF {
+			h.Logger.Info(err.Error())
+		}
+	case <-h.closing:
+		// both tunnels return once the connections are closed
+		backConn.Close()
+	}
+}
+
+// tunnel copies src to dst, and reports the end of the copy.
+func tunnel(dst io.Writer, src io.Reader, errc chan<- error) {
+	_, err := io.Copy(dst, src)
+	errc <- err
+}
+
+func upgradeType(header http.Header) string {
+	if !headerHasToken(header, "Connection", "upgrade") {
+		return ""
+	}
+	return header.Get("Upgrade")
+}
+
+// statusRecorder records the response code for the metrics.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Hijack reports the hijacked connection as switching protocols.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	r.code = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
 	}
 }
@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hexiaodai/fence/internal/config"
+)
+
+// newTestProxy returns a fence-proxy which forwards every request to upstream, as the
+// requests redirected by the Sidecars carry their original destination.
+func newTestProxy(t *testing.T, upstream *httptest.Server) (*httptest.Server, func(req *http.Request)) {
+	t.Helper()
+	server := config.Default()
+	hp, err := NewHttpProxy(server.WormholePort, nil, NewTransportPool(server), server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(hp)
+	t.Cleanup(proxy.Close)
+	origDest := strings.TrimPrefix(upstream.URL, "http://")
+	return proxy, func(req *http.Request) {
+		req.Host = "reviews.default"
+		req.Header.Set(HeaderOrigDest, origDest)
+	}
+}
+
+func TestRequestHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Clone()
+		header.Set("Host", r.Host)
+		received <- header
+	}))
+	defer upstream.Close()
+	proxy, toUpstream := newTestProxy(t, upstream)
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	toUpstream(req)
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	req.Header.Set("Te", "trailers, deflate;q=0.5")
+	req.Header.Set("X-End", "1")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	header := <-received
+	for _, name := range []string{"X-Hop", "Keep-Alive", "Proxy-Authorization", HeaderOrigDest} {
+		if v := header.Get(name); v != "" {
+			t.Errorf("%v = %q, want it stripped", name, v)
+		}
+	}
+	for name, want := range map[string]string{
+		"Host":              "reviews.default",
+		"X-End":             "1",
+		"Te":                "trailers",
+		"X-Forwarded-For":   "10.0.0.1, 127.0.0.1",
+		"X-Forwarded-Host":  "reviews.default",
+		"X-Forwarded-Proto": "http",
+		"Via":               "1.1 fence-proxy",
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("%v = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestRequestHeadersKeepForwardedHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+	}))
+	defer upstream.Close()
+	proxy, toUpstream := newTestProxy(t, upstream)
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	toUpstream(req)
+	req.Header.Set("Te", "gzip")
+	req.Header.Set("X-Forwarded-Host", "bookinfo.example.com")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("Via", "1.1 gateway")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	header := <-received
+	if v := header.Get("Te"); v != "" {
+		t.Errorf("Te = %q, want it stripped without trailers", v)
+	}
+	for name, want := range map[string]string{
+		"X-Forwarded-Host":  "bookinfo.example.com",
+		"X-Forwarded-Proto": "https",
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("%v = %q, want %q", name, got, want)
+		}
+	}
+	if got, want := strings.Join(header.Values("Via"), ", "), "1.1 gateway, 1.1 fence-proxy"; got != want {
+		t.Errorf("Via = %q, want %q", got, want)
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-End", "1")
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	proxy, toUpstream := newTestProxy(t, upstream)
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	toUpstream(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	for _, name := range []string{"Connection", "X-Hop", "Keep-Alive", "Proxy-Authenticate"} {
+		if v := resp.Header.Get(name); v != "" {
+			t.Errorf("%v = %q, want it stripped", name, v)
+		}
+	}
+	for name, want := range map[string]string{
+		"X-End": "1",
+		"Via":   "1.1 fence-proxy",
+	} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("%v = %q, want %q", name, got, want)
+		}
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "ok" {
+		t.Errorf("body = %q, want %q", body, "ok")
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "body")
+		w.(http.Flusher).Flush()
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer upstream.Close()
+	proxy, toUpstream := newTestProxy(t, upstream)
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	toUpstream(req)
+	req.Header.Set("Te", "trailers")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if _, ok := resp.Trailer["X-Checksum"]; !ok {
+		t.Errorf("Trailer = %v, want X-Checksum announced", resp.Trailer)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "body" {
+		t.Errorf("body = %q, want %q", body, "body")
+	}
+	if got := resp.Trailer.Get("X-Checksum"); got != "abc" {
+		t.Errorf("X-Checksum trailer = %q, want %q", got, "abc")
+	}
+}
+
+func TestUnannouncedTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "body")
+		w.(http.Flusher).Flush()
+		w.Header().Set(http.TrailerPrefix+"X-Late", "1")
+	}))
+	defer upstream.Close()
+	proxy, toUpstream := newTestProxy(t, upstream)
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	toUpstream(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	io.ReadAll(resp.Body)
+	if got := resp.Trailer.Get("X-Late"); got != "1" {
+		t.Errorf("X-Late trailer = %q, want %q", got, "1")
+	}
+}
+
+func TestRedirectIsForwarded(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			io.WriteString(w, "followed by the proxy")
+			return
+		}
+		http.Redirect(w, r, "http://details.default/moved", http.StatusFound)
+	}))
+	defer upstream.Close()
+	proxy, toUpstream := newTestProxy(t, upstream)
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	toUpstream(req)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("status = %v, want %v", resp.StatusCode, http.StatusFound)
+	}
+	if got, want := resp.Header.Get("Location"), "http://details.default/moved"; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+}
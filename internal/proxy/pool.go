@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hexiaodai/fence/internal/config"
+	"golang.org/x/net/http2"
+)
+
+// TransportPool shares the http.Transports, and their keep-alive connections, between the
+// requests to the same original destination ip:port. It holds at most ProxyMaxDestinations
+// transports, evicting the least recently used one, and evicts the transports which have
+// been idle for longer than ProxyIdleTimeout.
+type TransportPool struct {
+	mu sync.Mutex
+	// map[ip:port]*list.Element of *pooledTransport
+	transports map[string]*list.Element
+	// lru is ordered from the most to the least recently used transport
+	lru    *list.List
+	dialer *net.Dialer
+	config.Server
+}
+
+type pooledTransport struct {
+	addr      string
+	transport *http.Transport
+	// h2Transport speaks HTTP/2 without TLS (h2c), e.g. for gRPC. it is created on first use.
+	h2Transport *http2.Transport
+	lastUsed    time.Time
+}
+
+func NewTransportPool(server config.Server) *TransportPool {
+	server.Logger = server.Logger.WithName("TransportPool").WithValues("proxy", "TransportPool")
+	return &TransportPool{
+		transports: map[string]*list.Element{},
+		lru:        list.New(),
+		dialer:     &net.Dialer{KeepAlive: 30 * time.Second},
+		Server:     server,
+	}
+}
+
+// Start evicts the idle transports until ctx is done. The transports are recreated with
+// the limits of the reloaded configuration.
+func (p *TransportPool) Start(ctx context.Context) {
+	p.OnReload(func(old, new config.Server) {
+		if old.ProxyMaxIdleConnsPerDestination != new.ProxyMaxIdleConnsPerDestination ||
+			old.ProxyMaxConnsPerDestination != new.ProxyMaxConnsPerDestination ||
+			old.ProxyIdleTimeout != new.ProxyIdleTimeout {
+			p.closeAll()
+		}
+	})
+	go func() {
+		for {
+			// the idle timeout may be reloaded, the interval follows it
+			interval := p.Current().ProxyIdleTimeout / 2
+			if interval <= 0 {
+				interval = time.Minute
+			}
+			select {
+			case <-ctx.Done():
+				p.closeAll()
+				return
+			case <-time.After(interval):
+				p.evictIdle()
+			}
+		}
+	}()
+}
+
+// Get returns the transport which dials addr, the original destination ip:port.
+// The HTTP/2 transport is returned for h2, the HTTP/1.1 one otherwise.
+func (p *TransportPool) Get(addr string, h2 bool) http.RoundTripper {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	maxDestinations := p.Current().ProxyMaxDestinations
+	var pt *pooledTransport
+	if elem, ok := p.transports[addr]; ok {
+		pt = elem.Value.(*pooledTransport)
+		pt.lastUsed = time.Now()
+		p.lru.MoveToFront(elem)
+	} else {
+		pt = &pooledTransport{addr: addr, transport: p.newTransport(addr), lastUsed: time.Now()}
+		p.transports[addr] = p.lru.PushFront(pt)
+		for maxDestinations > 0 && p.lru.Len() > maxDestinations {
+			p.remove(p.lru.Back())
+		}
+	}
+
+	if !h2 {
+		return pt.transport
+	}
+	if pt.h2Transport == nil {
+		pt.h2Transport = p.newH2Transport(addr)
+	}
+	return pt.h2Transport
+}
+
+func (p *TransportPool) newTransport(addr string) *http.Transport {
+	current := p.Current()
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return p.dialer.DialContext(ctx, network, addr)
+		},
+		MaxIdleConns:          current.ProxyMaxIdleConnsPerDestination,
+		MaxIdleConnsPerHost:   current.ProxyMaxIdleConnsPerDestination,
+		MaxConnsPerHost:       current.ProxyMaxConnsPerDestination,
+		IdleConnTimeout:       current.ProxyIdleTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+func (p *TransportPool) newH2Transport(addr string) *http2.Transport {
+	return &http2.Transport{
+		// the original destination is reached in cleartext, the mTLS is up to its sidecar
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, _ string, _ *tls.Config) (net.Conn, error) {
+			return p.dialer.DialContext(ctx, network, addr)
+		},
+		ReadIdleTimeout: 30 * time.Second,
+	}
+}
+
+func (p *TransportPool) evictIdle() {
+	idleTimeout := p.Current().ProxyIdleTimeout
+	if idleTimeout <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	deadline := time.Now().Add(-idleTimeout)
+	for elem := p.lru.Back(); elem != nil; elem = p.lru.Back() {
+		if elem.Value.(*pooledTransport).lastUsed.After(deadline) {
+			return
+		}
+		p.remove(elem)
+	}
+}
+
+func (p *TransportPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for elem := p.lru.Back(); elem != nil; elem = p.lru.Back() {
+		p.remove(elem)
+	}
+}
+
+// remove drops the transport. The connections of the requests in flight are closed
+// after IdleConnTimeout once they are done.
+func (p *TransportPool) remove(elem *list.Element) {
+	pt := p.lru.Remove(elem).(*pooledTransport)
+	delete(p.transports, pt.addr)
+	pt.transport.CloseIdleConnections()
+	if pt.h2Transport != nil {
+		pt.h2Transport.CloseIdleConnections()
+	}
+	p.Logger.Sugar().Debugw("transport evicted", "addr", pt.addr)
+}
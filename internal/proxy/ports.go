@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hexiaodai/fence/internal/config"
+	"github.com/hexiaodai/fence/internal/options"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// FenceProxyName is the name of the fence-proxy Service, whose ports are bound by the controller.
+const FenceProxyName = "fence-proxy"
+
+func NewPortWatcher(serve *Serve, server config.Server) *PortWatcher {
+	server.Logger = server.Logger.WithName("PortWatcher").WithValues("proxy", "PortWatcher")
+	return &PortWatcher{serve: serve, Server: server}
+}
+
+// PortWatcher keeps the wormhole listeners of fence-proxy in line with the target ports of
+// the fence-proxy Service. The WormholePort is always listened on.
+type PortWatcher struct {
+	serve *Serve
+	config.Server
+}
+
+func (p *PortWatcher) Start(ctx context.Context) error {
+	config, err := options.DefaultConfigFlags.ToRawKubeConfigLoader().ClientConfig()
+	if err != nil {
+		return err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	fieldSelector := fields.OneTermEqualSelector("metadata.name", FenceProxyName).String()
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fieldSelector
+			return client.CoreV1().Services(p.FenceNamespace).List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fieldSelector
+			return client.CoreV1().Services(p.FenceNamespace).Watch(ctx, options)
+		},
+	}
+	_, controller := cache.NewInformer(lw, &corev1.Service{}, 60*time.Second, cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { p.handleServiceUpdate(obj) },
+		UpdateFunc: func(_, newObj interface{}) { p.handleServiceUpdate(newObj) },
+		DeleteFunc: func(obj interface{}) { p.serve.Sync(p.WormholePort) },
+	})
+
+	go controller.Run(ctx.Done())
+
+	if !cache.WaitForCacheSync(ctx.Done(), controller.HasSynced) {
+		return fmt.Errorf("failed to wait for fence-proxy service cache sync")
+	}
+
+	p.Logger.Info("started")
+	return nil
+}
+
+func (p *PortWatcher) handleServiceUpdate(obj interface{}) {
+	svc, ok := obj.(*corev1.Service)
+	if !ok {
+		return
+	}
+	ports := []string{p.WormholePort}
+	for _, sp := range svc.Spec.Ports {
+		if sp.Protocol != corev1.ProtocolTCP || sp.TargetPort.IntValue() == 0 {
+			continue
+		}
+		// e.g. the status port is served by healthz
+		if sp.TargetPort.IntValue() != int(sp.Port) && strconv.Itoa(sp.TargetPort.IntValue()) != p.WormholePort {
+			continue
+		}
+		ports = append(ports, strconv.Itoa(sp.TargetPort.IntValue()))
+	}
+	p.serve.Sync(ports...)
+	p.Logger.Sugar().Debugw("wormhole ports synced", "ports", p.serve.Ports())
+}
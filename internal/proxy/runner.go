@@ -13,6 +13,7 @@ func New(server config.Server) *Runner {
 }
 
 type Runner struct {
+	serve *Serve
 	config.Server
 }
 
@@ -22,13 +23,31 @@ func (r *Runner) Start(ctx context.Context) error {
 		return err
 	}
 
-	serve, err := NewServe(serviceCache, r.Server)
+	transportPool := NewTransportPool(r.Server)
+	transportPool.Start(ctx)
+
+	serve, err := NewServe(serviceCache, transportPool, r.Server)
 	if err != nil {
 		return err
 	}
 
 	serve.ListenAndServe(r.WormholePort)
+	r.serve = serve
+
+	// the ports bound to fence-proxy are listened on once they are added to its Service
+	portWatcher := NewPortWatcher(serve, r.Server)
+	if err := portWatcher.Start(ctx); err != nil {
+		return err
+	}
 
 	r.Logger.Info("started")
 	return nil
 }
+
+// Wait drains the wormhole listeners once ctx is done, and returns when they are all stopped.
+func (r *Runner) Wait(ctx context.Context) {
+	<-ctx.Done()
+	if r.serve != nil {
+		r.serve.Shutdown()
+	}
+}
@@ -5,30 +5,35 @@ import (
 	"fmt"
 	"net"
 	"net/http"
-	"strconv"
+	"sort"
 	"sync"
 	"syscall"
-	"time"
 
 	"github.com/hexiaodai/fence/internal/cache"
 	"github.com/hexiaodai/fence/internal/config"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/sys/unix"
 )
 
-func NewServe(serviceCache *cache.Service, server config.Server) (*Serve, error) {
+func NewServe(serviceCache *cache.Service, transportPool *TransportPool, server config.Server) (*Serve, error) {
 	s := &Serve{
-		serviceCache: serviceCache,
-		servers:      make(map[string]*http.Server),
-		Server:       server,
+		serviceCache:  serviceCache,
+		transportPool: transportPool,
+		servers:       make(map[string]*http.Server),
+		Server:        server,
 	}
 	s.Logger = s.Logger.WithName(s.Name()).WithValues("proxy", s.Name())
 	return s, nil
 }
 
 type Serve struct {
-	serverMutex  sync.RWMutex
-	servers      map[string]*http.Server
-	serviceCache *cache.Service
+	serverMutex sync.RWMutex
+	servers     map[string]*http.Server
+	// wg tracks the serving and draining goroutines
+	wg            sync.WaitGroup
+	serviceCache  *cache.Service
+	transportPool *TransportPool
 	config.Server
 }
 
@@ -42,28 +47,75 @@ func (s *Serve) ListenAndServe(wormholePorts ...string) {
 
 	s.Logger.Info("starting listen and serve with wormholePorts", "wormholePorts", wormholePorts)
 	for _, whPort := range wormholePorts {
-		if _, exist := s.servers[whPort]; !exist {
-			if whPort == s.ProbePort {
-				s.Logger.Info("probePort is conflict with wormholePort. skip port bind", "wormholePort", whPort)
-				continue
-			}
-			handler, err := NewHttpProxy(whPort, s.serviceCache, s.Server)
-			if err != nil {
-				s.Logger.Error(err, "skip port bind", "wormholePort", whPort)
-				continue
-			}
-			srv := &http.Server{
-				Addr:    fmt.Sprintf(":%v", whPort),
-				Handler: handler,
-			}
-			s.servers[whPort] = srv
-			go s.startServer(srv)
-		}
+		s.listenAndServe(whPort)
 	}
 	s.Logger.Info("started")
 }
 
-func (s *Serve) startServer(srv *http.Server) {
+// Sync opens the listeners of wormholePorts which are not open yet, and drains the ones
+// which are not wanted anymore.
+func (s *Serve) Sync(wormholePorts ...string) {
+	s.serverMutex.Lock()
+	defer s.serverMutex.Unlock()
+
+	wanted := map[string]struct{}{}
+	for _, whPort := range wormholePorts {
+		wanted[whPort] = struct{}{}
+		s.listenAndServe(whPort)
+	}
+	for whPort := range s.servers {
+		if _, ok := wanted[whPort]; !ok {
+			s.shutdownServer(whPort)
+		}
+	}
+}
+
+// Ports returns the ports listened on, sorted.
+func (s *Serve) Ports() []string {
+	s.serverMutex.RLock()
+	defer s.serverMutex.RUnlock()
+
+	ports := make([]string, 0, len(s.servers))
+	for whPort := range s.servers {
+		ports = append(ports, whPort)
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+func (s *Serve) listenAndServe(whPort string) {
+	if _, exist := s.servers[whPort]; exist {
+		return
+	}
+	if whPort == s.ProbePort || whPort == s.MetricsPort {
+		s.Logger.Info("probePort or metricsPort is conflict with wormholePort. skip port bind", "wormholePort", whPort)
+		return
+	}
+	handler, err := NewHttpProxy(whPort, s.serviceCache, s.transportPool, s.Server)
+	if err != nil {
+		s.Logger.Error(err, "skip port bind", "wormholePort", whPort)
+		return
+	}
+	// h2c serves HTTP/2 without TLS next to HTTP/1.1, e.g. for gRPC clients
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%v", whPort),
+		Handler: h2c.NewHandler(handler, &http2.Server{}),
+	}
+	// the hijacked connections are not drained by Shutdown, they are closed by the proxy
+	srv.RegisterOnShutdown(handler.closeUpgraded)
+
+	l, err := s.listen(srv.Addr)
+	if err != nil {
+		s.Logger.Error(err, "proxy listen error", "wormholePort", whPort)
+		return
+	}
+	s.servers[whPort] = srv
+	s.wg.Add(1)
+	go s.startServer(srv, l)
+	s.Logger.Info("listening", "wormholePort", whPort)
+}
+
+func (s *Serve) listen(addr string) (net.Listener, error) {
 	lc := net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) error {
 			return c.Control(func(fd uintptr) {
@@ -72,23 +124,54 @@ func (s *Serve) startServer(srv *http.Server) {
 			})
 		},
 	}
-	l, err := lc.Listen(context.Background(), "tcp", srv.Addr)
-	if err != nil {
-		s.Logger.Error(err, "proxy listen error")
-		return
-	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+func (s *Serve) startServer(srv *http.Server, l net.Listener) {
+	defer s.wg.Done()
 	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
 		s.Logger.Error(err, "proxy serve error")
 	}
 }
 
 func (s *Serve) ShutdownServer(wormholePort int32) error {
-	srv := s.servers[strconv.Itoa(int(wormholePort))]
+	s.serverMutex.Lock()
+	defer s.serverMutex.Unlock()
+
+	s.shutdownServer(fmt.Sprint(wormholePort))
+	return nil
+}
+
+// shutdownServer stops accepting connections on whPort at once, and drains the requests in
+// flight in the background for up to ProxyDrainTimeout.
+func (s *Serve) shutdownServer(whPort string) {
+	srv := s.servers[whPort]
 	if srv == nil {
-		return nil
+		return
 	}
-	s.Logger.Info("stopting proxy", "addr", srv.Addr)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	return srv.Shutdown(ctx)
+	delete(s.servers, whPort)
+
+	s.Logger.Info("stopping proxy", "addr", srv.Addr)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), s.ProxyDrainTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			s.Logger.Error(err, "failed to drain proxy, closing it", "addr", srv.Addr)
+			srv.Close()
+		}
+	}()
+}
+
+// Shutdown drains every listener, and waits until they are all stopped.
+func (s *Serve) Shutdown() {
+	s.serverMutex.Lock()
+	for whPort := range s.servers {
+		s.shutdownServer(whPort)
+	}
+	s.serverMutex.Unlock()
+
+	s.wg.Wait()
+	s.Logger.Info("stopped")
 }
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hexiaodai/fence/internal/config"
+)
+
+// freePorts returns n ports nothing listens on.
+func freePorts(t *testing.T, n int) []string {
+	t.Helper()
+	ports := []string{}
+	for len(ports) < n {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, fmt.Sprint(l.Addr().(*net.TCPAddr).Port))
+		l.Close()
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// eventually polls cond for up to 5s.
+func eventually(t *testing.T, cond func() bool, format string, args ...interface{}) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+	}
+}
+
+func TestServeSync(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+	}))
+	origDest := strings.TrimPrefix(upstream.URL, "http://")
+
+	server := config.Default()
+	server.ProxyDrainTimeout = 5 * time.Second
+	serve, err := NewServe(nil, NewTransportPool(server), server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func(port, path string) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%v%v", port, path), nil)
+		req.Host = "reviews.default"
+		req.Header.Set(HeaderOrigDest, origDest)
+		return client.Do(req)
+	}
+
+	ports := freePorts(t, 2)
+	serve.Sync(ports...)
+	if got := serve.Ports(); !reflect.DeepEqual(got, ports) {
+		t.Fatalf("Ports() = %v, want %v", got, ports)
+	}
+	for _, port := range ports {
+		resp, err := get(port, "/")
+		if err != nil {
+			t.Fatalf("GET :%v error = %v", port, err)
+		}
+		resp.Body.Close()
+	}
+
+	// the request in flight on the dropped port completes
+	slow := make(chan error, 1)
+	go func() {
+		resp, err := get(ports[1], "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		slow <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	serve.Sync(ports[0])
+	if got, want := serve.Ports(), ports[:1]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Ports() = %v, want %v", got, want)
+	}
+	eventually(t, func() bool {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+ports[1])
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}, "port %v still accepts connections", ports[1])
+	close(release)
+	if err := <-slow; err != nil {
+		t.Errorf("GET :%v/slow error = %v, want it drained", ports[1], err)
+	}
+
+	serve.Shutdown()
+	if got := serve.Ports(); len(got) != 0 {
+		t.Errorf("Ports() = %v, want none", got)
+	}
+	upstream.Close()
+	eventually(t, func() bool { return runtime.NumGoroutine() <= goroutines }, "goroutines leaked, want at most %v", goroutines)
+}
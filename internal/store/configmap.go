@@ -0,0 +1,115 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/hexiaodai/fence/internal/cache"
+	"github.com/hexiaodai/fence/internal/config"
+	"github.com/hexiaodai/fence/internal/monitoring"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	configMapKey = "dependencies.json"
+	// maxConfigMapSize is the size limit of the data of a ConfigMap
+	maxConfigMapSize = 1 << 20
+)
+
+// ConfigMap stores the dependency records in a ConfigMap. A ConfigMap is limited to 1MiB,
+// which holds about 4k dependencies of about 250 bytes each; the least recently seen records
+// over the limit are not saved. The file store has no limit.
+type ConfigMap struct {
+	config.Server
+	// reader should not be backed by a cache, to avoid caching every ConfigMap of the cluster.
+	reader client.Reader
+	writer client.Writer
+	nn     types.NamespacedName
+	// overflowed is set once a save went over the size limit, to warn only once
+	overflowed bool
+}
+
+func NewConfigMap(reader client.Reader, writer client.Writer, nn types.NamespacedName, server config.Server) *ConfigMap {
+	server.Logger = server.Logger.WithName("Store").WithValues("store", "ConfigMap")
+	return &ConfigMap{reader: reader, writer: writer, nn: nn, Server: server}
+}
+
+func (c *ConfigMap) Load(ctx context.Context) ([]cache.DependencyRecord, error) {
+	cm := &corev1.ConfigMap{}
+	if err := c.reader.Get(ctx, c.nn, cm); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get configmap. namespaceName %v. %w", c.nn, err)
+	}
+	data, ok := cm.Data[configMapKey]
+	if !ok {
+		return nil, nil
+	}
+	return decode([]byte(data))
+}
+
+func (c *ConfigMap) Save(ctx context.Context, records []cache.DependencyRecord) error {
+	data, err := encode(records)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxConfigMapSize {
+		kept := 0
+		if data, kept, err = fit(records); err != nil {
+			return err
+		}
+		monitoring.DependencyStoreOverflows.Inc()
+		if !c.overflowed {
+			c.overflowed = true
+			c.Logger.Sugar().Warnw("dependencies exceed the configmap size limit, the least recently seen are not saved, use the file store to keep them all",
+				"namespaceName", c.nn, "dependencies", len(records), "saved", kept, "limit", maxConfigMapSize)
+		}
+	}
+	monitoring.DependencyStoreBytes.Set(float64(len(data)))
+
+	cm := &corev1.ConfigMap{}
+	if err := c.reader.Get(ctx, c.nn, cm); err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to get configmap. namespaceName %v. %w", c.nn, err)
+		}
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: c.nn.Namespace, Name: c.nn.Name},
+			Data:       map[string]string{configMapKey: string(data)},
+		}
+		return c.writer.Create(ctx, cm)
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[configMapKey] = string(data)
+	return c.writer.Update(ctx, cm)
+}
+
+// fit encodes the most recently seen records that fit in maxConfigMapSize, and returns how many it kept.
+func fit(records []cache.DependencyRecord) ([]byte, int, error) {
+	sorted := append([]cache.DependencyRecord(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].LastSeen.After(sorted[j].LastSeen)
+	})
+	// the largest n whose encoding fits; encode(sorted[:0]) always does
+	var fitErr error
+	n := sort.Search(len(sorted), func(n int) bool {
+		data, err := encode(sorted[:n+1])
+		if err != nil {
+			fitErr = err
+			return true
+		}
+		return len(data) > maxConfigMapSize
+	})
+	if fitErr != nil {
+		return nil, 0, fitErr
+	}
+	data, err := encode(sorted[:n])
+	return data, n, err
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hexiaodai/fence/internal/cache"
+	"github.com/hexiaodai/fence/internal/config"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestConfigMapSaveOverLimit(t *testing.T) {
+	client := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()
+	store := NewConfigMap(client, client, types.NamespacedName{Namespace: "fence", Name: "fence-dependencies"}, config.Default())
+
+	source := types.NamespacedName{Namespace: "default", Name: "deployment-productpage"}
+	now := time.Now().Truncate(time.Second)
+	records := []cache.DependencyRecord{}
+	for i := 0; i < 10000; i++ {
+		seen := now.Add(-time.Duration(i) * time.Second)
+		records = append(records, cache.DependencyRecord{
+			Source:      source,
+			Destination: fmt.Sprintf("service-%05d.default.svc.cluster.local", i),
+			FirstSeen:   seen,
+			LastSeen:    seen,
+			Requests:    1,
+		})
+	}
+	if data, _ := encode(records); len(data) <= maxConfigMapSize {
+		t.Fatalf("encode() = %v bytes, want more than %v", len(data), maxConfigMapSize)
+	}
+
+	ctx := context.Background()
+	// the second save updates the ConfigMap created by the first
+	for i := 0; i < 2; i++ {
+		if err := store.Save(ctx, records); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+	}
+
+	restored, err := store.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(restored) == 0 || len(restored) >= len(records) {
+		t.Fatalf("len(Load()) = %v, want between 0 and %v", len(restored), len(records))
+	}
+	if data, _ := encode(restored); len(data) > maxConfigMapSize {
+		t.Errorf("saved %v bytes, want at most %v", len(data), maxConfigMapSize)
+	}
+	if data, _ := encode(records[:len(restored)+1]); len(data) <= maxConfigMapSize {
+		t.Errorf("saved %v dependencies, want as many as fit", len(restored))
+	}
+	// the most recently seen records are kept
+	for i, record := range restored {
+		if record.Destination != records[i].Destination || !record.LastSeen.Equal(records[i].LastSeen) {
+			t.Fatalf("Load()[%v] = %v %v, want %v %v", i, record.Destination, record.LastSeen, records[i].Destination, records[i].LastSeen)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/hexiaodai/fence/internal/cache"
+)
+
+// File stores the dependency records in a local file. It is meant for tests and
+// single replica deployments with a persistent volume.
+type File struct {
+	path string
+}
+
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+func (f *File) Load(ctx context.Context) ([]cache.DependencyRecord, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return decode(data)
+}
+
+// Save writes to a temporary file first, so that a crash never leaves a truncated file behind.
+func (f *File) Save(ctx context.Context, records []cache.DependencyRecord) error {
+	data, err := encode(records)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hexiaodai/fence/internal/cache"
+	"github.com/hexiaodai/fence/internal/config"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	TypeNone      = "none"
+	TypeConfigMap = "configmap"
+	TypeFile      = "file"
+)
+
+// documentVersion is the version of the persisted document.
+const documentVersion = 1
+
+// Store persists the learned dependency graph across controller restarts.
+type Store interface {
+	// Load returns the persisted dependency records. A store without data returns no records.
+	Load(ctx context.Context) ([]cache.DependencyRecord, error)
+	// Save replaces the persisted dependency records.
+	Save(ctx context.Context, records []cache.DependencyRecord) error
+}
+
+// New returns the Store configured by DependencyStore. It returns nil if persistence is disabled.
+func New(reader client.Reader, writer client.Writer, server config.Server) (Store, error) {
+	switch server.DependencyStore {
+	case TypeNone, "":
+		return nil, nil
+	case TypeConfigMap:
+		return NewConfigMap(reader, writer, types.NamespacedName{Namespace: server.FenceNamespace, Name: "fence-dependencies"}, server), nil
+	case TypeFile:
+		return NewFile(server.DependencyStorePath), nil
+	default:
+		return nil, fmt.Errorf("unknown dependency store %q, supported stores are %v, %v and %v", server.DependencyStore, TypeNone, TypeConfigMap, TypeFile)
+	}
+}
+
+type document struct {
+	Version      int          `json:"version"`
+	Dependencies []dependency `json:"dependencies"`
+}
+
+type dependency struct {
+	// Source is "namespace/name".
+	Source        string            `json:"source"`
+	Destination   string            `json:"destination"`
+	FirstSeen     time.Time         `json:"firstSeen"`
+	LastSeen      time.Time         `json:"lastSeen"`
+	Requests      uint64            `json:"requests"`
+	ResponseCodes map[uint32]uint64 `json:"responseCodes,omitempty"`
+}
+
+func encode(records []cache.DependencyRecord) ([]byte, error) {
+	doc := document{Version: documentVersion, Dependencies: []dependency{}}
+	for _, record := range records {
+		doc.Dependencies = append(doc.Dependencies, dependency{
+			Source:        record.Source.String(),
+			Destination:   record.Destination,
+			FirstSeen:     record.FirstSeen,
+			LastSeen:      record.LastSeen,
+			Requests:      record.Requests,
+			ResponseCodes: record.ResponseCodes,
+		})
+	}
+	return json.Marshal(doc)
+}
+
+func decode(data []byte) ([]cache.DependencyRecord, error) {
+	doc := document{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Version != documentVersion {
+		return nil, fmt.Errorf("unsupported document version %v", doc.Version)
+	}
+	records := []cache.DependencyRecord{}
+	for _, dep := range doc.Dependencies {
+		parts := strings.SplitN(dep.Source, string(types.Separator), 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid source %q", dep.Source)
+		}
+		records = append(records, cache.DependencyRecord{
+			Source:        types.NamespacedName{Namespace: parts[0], Name: parts[1]},
+			Destination:   dep.Destination,
+			FirstSeen:     dep.FirstSeen,
+			LastSeen:      dep.LastSeen,
+			Requests:      dep.Requests,
+			ResponseCodes: dep.ResponseCodes,
+		})
+	}
+	return records, nil
+}